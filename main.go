@@ -1,54 +1,63 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/admin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/audit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
 	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/bodylimit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+	"github.com/gyarbij/azure-oai-proxy/pkg/coalesce"
+	"github.com/gyarbij/azure-oai-proxy/pkg/health"
+	"github.com/gyarbij/azure-oai-proxy/pkg/keys"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
 	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+	"github.com/gyarbij/azure-oai-proxy/pkg/queue"
+	"github.com/gyarbij/azure-oai-proxy/pkg/secrets"
+	"github.com/gyarbij/azure-oai-proxy/pkg/semcache"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tlsutil"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	Address   = "0.0.0.0:11437"
-	ProxyMode = "azure"
+	Address      = "0.0.0.0:11437"
+	ProxyMode    = "azure"
+	AdminAddress = "" // admin API is disabled unless a separate listener is configured
 )
 
-// Define the ModelList and Model types based on the API documentation
-type ModelList struct {
-	Object string  `json:"object"`
-	Data   []Model `json:"data"`
-}
+var keyStore *keys.Store
 
-type Model struct {
-	ID              string       `json:"id"`
-	Object          string       `json:"object"`
-	CreatedAt       int64        `json:"created_at"`
-	Capabilities    Capabilities `json:"capabilities"`
-	LifecycleStatus string       `json:"lifecycle_status"`
-	Status          string       `json:"status"`
-	Deprecation     Deprecation  `json:"deprecation"`
-	FineTune        string       `json:"fine_tune,omitempty"`
-}
+// The reverse proxies keep no per-request state, they are built once in main
+// so their transports and buffers are shared by all requests.
+var (
+	azureProxy  *httputil.ReverseProxy
+	openaiProxy *httputil.ReverseProxy
+)
 
-type Capabilities struct {
-	FineTune       bool `json:"fine_tune"`
-	Inference      bool `json:"inference"`
-	Completion     bool `json:"completion"`
-	ChatCompletion bool `json:"chat_completion"`
-	Embeddings     bool `json:"embeddings"`
-}
-
-type Deprecation struct {
-	FineTune  int64 `json:"fine_tune,omitempty"`
-	Inference int64 `json:"inference"`
-}
+// mappedDeployments are the deployments named in AZURE_OPENAI_MODEL_MAPPER,
+// probed by the readiness checks.
+var mappedDeployments []string
 
 func init() {
 	// Load .env file if it exists
@@ -63,6 +72,9 @@ func init() {
 	if v := os.Getenv("AZURE_OPENAI_PROXY_MODE"); v != "" {
 		ProxyMode = v
 	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_ADMIN_ADDRESS"); v != "" {
+		AdminAddress = v
+	}
 	log.Printf("loading azure openai proxy address: %s", Address)
 	log.Printf("loading azure openai proxy mode: %s", ProxyMode)
 
@@ -72,13 +84,19 @@ func init() {
 			info := strings.Split(pair, "=")
 			if len(info) == 2 {
 				azure.AzureOpenAIModelMapper[info[0]] = info[1]
+				mappedDeployments = append(mappedDeployments, info[1])
 			}
 		}
 	}
 }
 
 func main() {
-	router := gin.Default()
+	if err := tracing.Setup(context.Background()); err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware(), logging.Middleware())
 
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
@@ -93,144 +111,691 @@ func main() {
 	})
 
 	// Proxy routes
+	azureProxy, openaiProxy = azure.NewOpenAIReverseProxy(), openai.NewOpenAIReverseProxy()
+	api := router.Group("/", bodylimit.Middleware(), auth.Middleware(setupAuthenticators()...))
 		if ProxyMode == "azure" {
-			router.GET("/v1/models", handleGetModels)
+			api.GET("/v1/models", handleGetModels)
+			api.GET("/v1/models/:model_id", handleGetModel)
 			// Existing routes
-			router.POST("/v1/chat/completions", handleAzureProxy)
-			router.POST("/v1/completions", handleAzureProxy)
-			router.POST("/v1/embeddings", handleAzureProxy)
+			api.POST("/v1/chat/completions", handleAzureProxy)
+			api.POST("/v1/completions", handleAzureProxy)
+			api.POST("/v1/embeddings", handleAzureProxy)
 			// DALL-E routes
-			router.POST("/v1/images/generations", handleAzureProxy)
+			api.POST("/v1/images/generations", handleAzureProxy)
 			// speech- routes
-			router.POST("/v1/audio/speech", handleAzureProxy)
-			router.GET("/v1/audio/voices", handleAzureProxy)
-			router.POST("/v1/audio/transcriptions", handleAzureProxy)
-			router.POST("/v1/audio/translations", handleAzureProxy)
+			api.POST("/v1/audio/speech", handleAzureProxy)
+			api.GET("/v1/audio/voices", handleAzureProxy)
+			api.POST("/v1/audio/transcriptions", handleAzureProxy)
+			api.POST("/v1/audio/translations", handleAzureProxy)
 			// Fine-tuning routes
-			router.POST("/v1/fine_tunes", handleAzureProxy)
-			router.GET("/v1/fine_tunes", handleAzureProxy)
-			router.GET("/v1/fine_tunes/:fine_tune_id", handleAzureProxy)
-			router.POST("/v1/fine_tunes/:fine_tune_id/cancel", handleAzureProxy)
-			router.GET("/v1/fine_tunes/:fine_tune_id/events", handleAzureProxy)
+			api.POST("/v1/fine_tunes", handleAzureProxy)
+			api.GET("/v1/fine_tunes", handleAzureProxy)
+			api.GET("/v1/fine_tunes/:fine_tune_id", handleAzureProxy)
+			api.POST("/v1/fine_tunes/:fine_tune_id/cancel", handleAzureProxy)
+			api.GET("/v1/fine_tunes/:fine_tune_id/events", handleAzureProxy)
 			// Files management routes
-			router.POST("/v1/files", handleAzureProxy)
-			router.GET("/v1/files", handleAzureProxy)
-			router.DELETE("/v1/files/:file_id", handleAzureProxy)
-			router.GET("/v1/files/:file_id", handleAzureProxy)
-			router.GET("/v1/files/:file_id/content", handleAzureProxy)
+			api.POST("/v1/files", handleAzureProxy)
+			api.GET("/v1/files", handleAzureProxy)
+			api.DELETE("/v1/files/:file_id", handleAzureProxy)
+			api.GET("/v1/files/:file_id", handleAzureProxy)
+			api.GET("/v1/files/:file_id/content", handleAzureProxy)
 			// Deployments management routes
-			router.GET("/deployments", handleAzureProxy)
-			router.GET("/deployments/:deployment_id", handleAzureProxy)
-			router.GET("/v1/models/:model_id/capabilities", handleAzureProxy)
+			api.GET("/deployments", handleAzureProxy)
+			api.GET("/deployments/:deployment_id", handleAzureProxy)
+			api.GET("/v1/models/:model_id/capabilities", handleAzureProxy)
 
 			// Responses API routes
-			router.POST("/v1/responses", handleAzureProxy)
-			router.GET("/v1/responses/:response_id", handleAzureProxy)
-			router.DELETE("/v1/responses/:response_id", handleAzureProxy)
-			router.POST("/v1/responses/:response_id/cancel", handleAzureProxy)
-			router.GET("/v1/responses/:response_id/input_items", handleAzureProxy)
+			api.POST("/v1/responses", handleAzureProxy)
+			api.GET("/v1/responses/:response_id", handleAzureProxy)
+			api.DELETE("/v1/responses/:response_id", handleAzureProxy)
+			api.POST("/v1/responses/:response_id/cancel", handleAzureProxy)
+			api.GET("/v1/responses/:response_id/input_items", handleAzureProxy)
 		} else {
-			router.Any("*path", handleOpenAIProxy)
+			api.Any("*path", handleOpenAIProxy)
 		}
 
+	// Prometheus metrics endpoint
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	// Health check endpoint
 	router.GET("/healthz", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status": "healthy",
 		})
 	})
+	router.GET("/livez", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	router.GET("/readyz", handleReadyz)
+
+	secrets.StartRefresh(context.Background())
+	if err := audit.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start audit log: %v", err)
+	}
+	if err := cache.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start response cache: %v", err)
+	}
+	if ProxyMode == "azure" {
+		azure.StartKeyRotation(context.Background())
+		azure.StartModelRefresh(context.Background())
+		azure.StartBalanceProbes(context.Background(), mappedDeployments)
+		semcache.Embed = embed
+		health.Register(azure.HealthChecks(mappedDeployments)...)
+	} else {
+		health.Register(openai.HealthChecks()...)
+	}
+	health.Start(context.Background())
+
+	if AdminAddress != "" {
+		go runAdmin()
+	}
+
+	server := &http.Server{Addr: Address, Handler: router}
+	if tlsutil.Enabled() {
+		tlsConfig, err := tlsutil.ServerConfig()
+		if err != nil {
+			log.Fatalf("error configuring tls: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// runAdmin serves the admin API on its own listener so it can be kept off
+// the network the public proxy address is exposed on.
+func runAdmin() {
+	if admin.Token.Get() == "" {
+		log.Printf("AZURE_OPENAI_PROXY_ADMIN_TOKEN is not set, not starting admin API")
+		return
+	}
+
+	router := gin.New()
+	router.Use(gin.Recovery())
+	// The page holds no data, it asks for the token and calls /admin/status.
+	router.GET("/admin/ui", admin.StatusPage)
+
+	api := router.Group("/admin", admin.RequireToken(admin.Token))
+	admin.RegisterKeyRoutes(api, openKeyStore())
+	api.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, health.Current())
+	})
+	api.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, struct {
+			Health health.Report `json:"health"`
+			azure.Status
+		}{health.Current(), azure.CurrentStatus()})
+	})
+
+	log.Printf("loading azure openai proxy admin address: %s", AdminAddress)
+	if err := router.Run(AdminAddress); err != nil {
+		log.Printf("admin API stopped: %v", err)
+	}
+}
+
+// openKeyStore opens the virtual key database, shared by the keys auth mode
+// and the admin API.
+func openKeyStore() *keys.Store {
+	if keyStore == nil {
+		store, err := keys.Open(keys.DBPath)
+		if err != nil {
+			log.Fatalf("error opening key store: %v", err)
+		}
+		keyStore = store
+	}
+	return keyStore
+}
+
+// setupAuthenticators builds the authenticators for the configured auth modes.
+func setupAuthenticators() []auth.Authenticator {
+	var authenticators []auth.Authenticator
+	for _, mode := range auth.Modes() {
+		switch mode {
+		case "jwt":
+			a, err := auth.NewJWTAuthenticator(auth.JWT)
+			if err != nil {
+				log.Fatalf("error configuring jwt auth: %v", err)
+			}
+			authenticators = append(authenticators, a)
+		case "keys":
+			authenticators = append(authenticators, keys.NewAuthenticator(openKeyStore()))
+		case "mtls":
+			if tlsutil.ClientCAFile == "" {
+				log.Fatalf("mtls auth mode requires AZURE_OPENAI_PROXY_TLS_CLIENT_CA_FILE")
+			}
+			a, err := auth.NewMTLSAuthenticator(auth.MTLSPolicyFile)
+			if err != nil {
+				log.Fatalf("error configuring mtls auth: %v", err)
+			}
+			authenticators = append(authenticators, a)
+		default:
+			log.Fatalf("unknown auth mode: %s", mode)
+		}
+	}
+	return authenticators
+}
 
-	router.Run(Address)
+// authorizeModel rejects requests for models the authenticated caller may not
+// use. Requests that don't target a model (files, stored responses) pass.
+func authorizeModel(c *gin.Context) bool {
+	id := auth.FromContext(c.Request.Context())
+	if id == nil {
+		return true
+	}
+	model := azure.GetModelFromRequest(c.Request)
+	if model == "" || id.AllowsModel(model) {
+		return true
+	}
+	apierror.Write(c.Writer, http.StatusForbidden, "invalid_request_error", "model_not_allowed", fmt.Sprintf("Access to model %q is not allowed", model))
+	c.Abort()
+	return false
 }
 
+// handleGetModels lists the models the caller may use in OpenAI's format.
 func handleGetModels(c *gin.Context) {
-	req, _ := http.NewRequest("GET", c.Request.URL.String(), nil)
-	req.Header.Set("Authorization", c.GetHeader("Authorization"))
+	id := auth.FromContext(c.Request.Context())
+	list, ok := modelsFor(c)
+	if !ok {
+		return
+	}
+	models := []azure.ModelEntry{}
+	for _, m := range list {
+		if id == nil || id.AllowsModel(m.ID) {
+			models = append(models, m)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": models})
+}
 
-	models, err := fetchDeployedModels(req)
-	if err != nil {
-		log.Printf("error fetching deployed models: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch deployed models"})
+func handleGetModel(c *gin.Context) {
+	id := auth.FromContext(c.Request.Context())
+	list, ok := modelsFor(c)
+	if !ok {
 		return
 	}
+	m, ok := azure.FindModel(list, c.Param("model_id"))
+	if !ok || id != nil && !id.AllowsModel(m.ID) {
+		// Models the caller may not use don't exist for it.
+		apierror.Write(c.Writer, http.StatusNotFound, "invalid_request_error", "model_not_found", fmt.Sprintf("The model %q does not exist", c.Param("model_id")))
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
 
-	// Add serverless deployments to the models list
-	for deploymentName := range azure.ServerlessDeploymentInfo {
-		models = append(models, Model{
-			ID:     deploymentName,
-			Object: "model",
-			Capabilities: Capabilities{
-				Completion:     true,
-				ChatCompletion: true,
-				Inference:      true,
-			},
-			LifecycleStatus: "active",
-			Status:          "ready",
-		})
+// modelsFor returns the models of the caller, or writes an error when they
+// couldn't be listed.
+func modelsFor(c *gin.Context) ([]azure.ModelEntry, bool) {
+	list, err := azure.ModelsFor(c.Request)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("error fetching deployed models", "error", err)
+		apierror.Write(c.Writer, http.StatusBadGateway, "proxy_error", "bad_gateway", "Failed to fetch deployed models")
+		return nil, false
 	}
+	return list, true
+}
 
-	result := ModelList{
-		Object: "list",
-		Data:   models,
+// handleReadyz reports the cached health check results. Details, which may
+// include upstream URLs and errors, are only on the admin API.
+func handleReadyz(c *gin.Context) {
+	report := health.Current()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
 	}
-	c.JSON(http.StatusOK, result)
+	c.JSON(status, gin.H{"status": report.Status, "ready": report.Ready})
 }
 
-func fetchDeployedModels(originalReq *http.Request) ([]Model, error) {
-	endpoint := os.Getenv("AZURE_OPENAI_ENDPOINT")
-	if endpoint == "" {
-		endpoint = azure.AzureOpenAIEndpoint
+func handleAzureProxy(c *gin.Context) {
+	ctx, info := azure.WithRequestInfo(c.Request.Context(), c.FullPath())
+	c.Request = c.Request.WithContext(ctx)
+	// Resolved here already so errors returned before the request is
+	// proxied carry the diagnostic headers too.
+	info.Model = azure.GetModelFromRequest(c.Request)
+	info.Backend, info.Deployment = azure.ResolveDeployment(info.Model)
+	azure.SetDiagnosticHeaders(c.Writer.Header(), info)
+	var requestBody json.RawMessage
+	defer func() {
+		model, deployment := info.MetricLabels()
+		metrics.Requests.WithLabelValues(info.Route, model, deployment, info.Backend, strconv.Itoa(c.Writer.Status())).Inc()
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("gen_ai.request.model", info.Model),
+			attribute.String("proxy.deployment", info.Deployment),
+			attribute.String("proxy.backend", info.Backend),
+			attribute.Int("gen_ai.usage.input_tokens", info.Usage.PromptTokens),
+			attribute.Int("gen_ai.usage.output_tokens", info.Usage.CompletionTokens),
+			attribute.Int("gen_ai.usage.cache_read.input_tokens", info.Usage.CachedTokens),
+			attribute.Int("proxy.retries", info.Retries),
+			attribute.String("proxy.request_id", logging.RequestID(ctx)),
+			attribute.String("proxy.upstream_request_id", info.UpstreamRequestID),
+		)
+		logging.AddAttrs(ctx,
+			"prompt_tokens", info.Usage.PromptTokens,
+			"completion_tokens", info.Usage.CompletionTokens,
+			"cached_tokens", info.Usage.CachedTokens,
+			"total_tokens", info.Usage.TotalTokens,
+			"retries", info.Retries,
+		)
+		auditRequest(c, info, requestBody)
+	}()
+
+	if !authorizeModel(c) {
+		return
 	}
+	requestBody = captureRequest(c, info)
+	hit, storeResponse := responseCache(c, info)
+	if hit {
+		return
+	}
+	hit, storeAnswer := semanticCache(c, info)
+	if hit {
+		return
+	}
+	shared, finish := coalesceRequest(c, info)
+	if shared {
+		return
+	}
+	if finish != nil {
+		defer finish()
+	}
+	// Picked after the caches, which are shared by all backends, as late as
+	// possible since it goes by their current load.
+	info.Backend = azure.PickBackend(c.Request, info.Model)
+	azure.SetDiagnosticHeaders(c.Writer.Header(), info)
+	release, err := queue.Acquire(ctx, queueRequest(c, info))
+	if err != nil {
+		if ctx.Err() == nil {
+			queue.Reject(c.Writer, err)
+		}
+		return
+	}
+	defer release()
+	azure.DelDiagnosticHeaders(c.Writer.Header())
+	defer azure.BeginRequest(info.Backend)()
+	switch {
+	case info.Route == "/v1/embeddings" && azure.ServeEmbeddings(azureProxy, c.Writer, c.Request):
+	case azure.ServeHedged(azureProxy, c.Writer, c.Request):
+	default:
+		azureProxy.ServeHTTP(c.Writer, c.Request)
+	}
+	if c.Writer.Header().Get("Content-Type") == "text/event-stream" {
+		if _, err := c.Writer.Write([]byte("\n")); err != nil {
+			logging.FromContext(ctx).Error("rewrite azure response error", "error", err)
+		}
+	}
+	for _, store := range []func(){storeResponse, storeAnswer} {
+		if store != nil {
+			store()
+		}
+	}
+}
 
-	// Use the separate models API version
-	modelsAPIVersion := azure.AzureOpenAIModelsAPIVersion
-	url := fmt.Sprintf("%s/openai/models?api-version=%s", endpoint, modelsAPIVersion)
+func handleOpenAIProxy(c *gin.Context) {
+	ctx, info := azure.WithRequestInfo(c.Request.Context(), c.FullPath())
+	c.Request = c.Request.WithContext(ctx)
+	model := azure.GetModelFromRequest(c.Request)
+	info.Model, info.Deployment, info.Backend = model, model, "openai"
+	azure.SetDiagnosticHeaders(c.Writer.Header(), info)
+	logging.AddAttrs(ctx, "model", model, "backend", "openai")
+	var requestBody json.RawMessage
+	defer func() {
+		label := openai.MetricModel(model, c.Writer.Status())
+		metrics.Requests.WithLabelValues(info.Route, label, label, "openai", strconv.Itoa(c.Writer.Status())).Inc()
+		auditRequest(c, info, requestBody)
+	}()
+
+	if !authorizeModel(c) {
+		return
+	}
+	requestBody = captureRequest(c, info)
+	hit, storeResponse := responseCache(c, info)
+	if hit {
+		return
+	}
+	shared, finish := coalesceRequest(c, info)
+	if shared {
+		return
+	}
+	if finish != nil {
+		defer finish()
+	}
+	release, err := queue.Acquire(ctx, queueRequest(c, info))
+	if err != nil {
+		if ctx.Err() == nil {
+			queue.Reject(c.Writer, err)
+		}
+		return
+	}
+	defer release()
+	defer azure.BeginRequest("openai")()
+	openaiProxy.ServeHTTP(c.Writer, c.Request)
+	if storeResponse != nil {
+		storeResponse()
+	}
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+// responseCache answers the request from the response cache when it can.
+// On a miss it returns a function that caches the response once it has been
+// proxied, or nil when the request isn't cacheable.
+func responseCache(c *gin.Context, info *azure.RequestInfo) (hit bool, store func()) {
+	ttl := cache.TTL(info.Route, info.Model)
+	if !cache.Enabled() || c.Request.Method != http.MethodPost || ttl <= 0 {
+		return false, nil
+	}
+	control := c.GetHeader("Cache-Control")
+	if strings.Contains(control, "no-store") {
+		metrics.CacheRequests.WithLabelValues(info.Route, "bypass").Inc()
+		return false, nil
+	}
+	body, ok := readRequestBody(c)
+	if !ok {
+		return false, nil
+	}
+
+	var temperature *float64
+	if t := gjson.GetBytes(body, "temperature"); t.Exists() {
+		v := t.Float()
+		temperature = &v
+	}
+	if !cache.Deterministic(info.Route, temperature) {
+		return false, nil
+	}
+	key, err := cache.Key(cacheScope(c), info.Backend+"/"+info.Deployment, info.Route, body)
 	if err != nil {
-		return nil, err
+		return false, nil
 	}
 
-	req.Header.Set("Authorization", originalReq.Header.Get("Authorization"))
+	if strings.Contains(control, "no-cache") {
+		metrics.CacheRequests.WithLabelValues(info.Route, "bypass").Inc()
+	} else if e, ok := cache.Get(key); ok {
+		metrics.CacheRequests.WithLabelValues(info.Route, "hit").Inc()
+		logging.AddAttrs(c.Request.Context(), "cache", "hit")
+		if info.Capture {
+			info.ResponseBody = e.Body
+		}
+		// Answered without going to a backend.
+		c.Writer.Header().Del(azure.BackendHeader)
+		c.Header(cache.Header, "hit")
+		c.Header("Age", e.Age())
+		c.Data(http.StatusOK, e.ContentType, e.Body)
+		return true, nil
+	} else {
+		metrics.CacheRequests.WithLabelValues(info.Route, "miss").Inc()
+	}
 
-	azure.HandleToken(req)
+	c.Header(cache.Header, "miss")
+	rec := &responseRecorder{ResponseWriter: c.Writer, limit: int(cache.MaxEntrySize)}
+	c.Writer = rec
+	return false, func() {
+		if rec.Status() == http.StatusOK && !rec.overflow {
+			cache.Set(key, rec.Header().Get("Content-Type"), rec.buf.Bytes(), ttl)
+		}
+	}
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// semanticCache answers a single chat question with the cached answer to a
+// similar enough one. On a miss it returns a function that caches the
+// answer once it has been proxied, or nil when the request isn't cacheable.
+func semanticCache(c *gin.Context, info *azure.RequestInfo) (hit bool, store func()) {
+	control := c.GetHeader("Cache-Control")
+	if !semcache.Enabled() || info.Route != "/v1/chat/completions" || strings.Contains(control, "no-store") {
+		return false, nil
+	}
+	body, ok := readRequestBody(c)
+	if !ok {
+		return false, nil
+	}
+	q, ok := semcache.NewQuery(cacheScope(c), info.Backend+"/"+info.Deployment, body)
+	if !ok {
+		return false, nil
+	}
+	model, _ := info.MetricLabels()
+	vector, err := semcache.Embed(c.Request.Context(), semcache.Model, q.Text)
 	if err != nil {
-		return nil, err
+		logging.FromContext(c.Request.Context()).Warn("semantic cache embedding failed", "error", err)
+		metrics.SemanticCacheRequests.WithLabelValues(model, "error").Inc()
+		return false, nil
+	}
+	q.Vector = semcache.Normalize(vector)
+
+	if !strings.Contains(control, "no-cache") {
+		e, similarity := semcache.Lookup(q)
+		if similarity > 0 {
+			metrics.SemanticCacheSimilarity.WithLabelValues(model).Observe(similarity)
+		}
+		if e != nil {
+			metrics.SemanticCacheRequests.WithLabelValues(model, "hit").Inc()
+			logging.AddAttrs(c.Request.Context(), "cache", "semantic_hit", "similarity", similarity)
+			if info.Capture {
+				info.ResponseBody = e.Body
+			}
+			c.Writer.Header().Del(azure.BackendHeader)
+			c.Header(cache.Header, "hit")
+			c.Header(semcache.SimilarityHeader, strconv.FormatFloat(similarity, 'f', 4, 64))
+			c.Data(http.StatusOK, e.ContentType, e.Body)
+			return true, nil
+		}
+		metrics.SemanticCacheRequests.WithLabelValues(model, "miss").Inc()
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to fetch deployed models: %s", string(body))
+	rec := &responseRecorder{ResponseWriter: c.Writer, limit: int(cache.MaxEntrySize)}
+	c.Writer = rec
+	return false, func() {
+		if rec.Status() == http.StatusOK && !rec.overflow {
+			semcache.Store(q, rec.Header().Get("Content-Type"), rec.buf.Bytes())
+		}
+	}
+}
+
+// coalesceRequest lets identical non-streaming requests of the same caller
+// share one upstream call. A request that waited on another one is answered
+// with its response and shared is true, as it is when the client went away
+// while waiting. Otherwise finish, when not nil, must be called once the
+// request has been proxied.
+func coalesceRequest(c *gin.Context, info *azure.RequestInfo) (shared bool, finish func()) {
+	if !coalesce.Enabled(info.Route) || c.Request.Method != http.MethodPost {
+		return false, nil
+	}
+	body, ok := readRequestBody(c)
+	if !ok || gjson.GetBytes(body, "stream").Bool() {
+		return false, nil
+	}
+	// Calls are only shared by requests made with the same key, whatever
+	// the cache scope, so nobody gets a response meant for other permissions.
+	scope := cache.KeyScope(auth.FromContext(c.Request.Context()), c.GetHeader("api-key")+c.GetHeader("Authorization"))
+	key, err := cache.Key(scope, info.Backend+"/"+info.Deployment, info.Route, body)
+	if err != nil {
+		return false, nil
 	}
 
-	var deployedModelsResponse ModelList
-	if err := json.NewDecoder(resp.Body).Decode(&deployedModelsResponse); err != nil {
+	f, leader := coalesce.Join(key)
+	if !leader {
+		res, err := f.Wait(c.Request.Context())
+		if err != nil {
+			// Nobody left to make a call for.
+			return true, nil
+		}
+		if res == nil {
+			return false, nil
+		}
+		metrics.CoalescedRequests.WithLabelValues(info.Route).Inc()
+		logging.AddAttrs(c.Request.Context(), "coalesced", true)
+		header := c.Writer.Header()
+		for k, v := range res.Header {
+			if k != http.CanonicalHeaderKey(apierror.RequestIDHeader) {
+				header[k] = v
+			}
+		}
+		header.Set(coalesce.Header, "true")
+		// The backend the shared call went to.
+		if b := res.Header.Get(azure.BackendHeader); b != "" {
+			info.Backend = b
+		}
+		if info.Capture {
+			info.ResponseBody = res.Body
+		}
+		c.Data(res.Status, res.Header.Get("Content-Type"), res.Body)
+		return true, nil
+	}
+
+	rec := &responseRecorder{ResponseWriter: c.Writer, limit: int(coalesce.MaxResponseSize)}
+	c.Writer = rec
+	return false, func() {
+		// Failed calls aren't shared, the waiting requests try themselves.
+		if rec.overflow || rec.Status() >= http.StatusInternalServerError || c.Request.Context().Err() != nil {
+			f.Finish(nil)
+			return
+		}
+		f.Finish(&coalesce.Response{Status: rec.Status(), Header: rec.Header().Clone(), Body: rec.buf.Bytes()})
+	}
+}
+
+// embed gets an embedding for the semantic cache through the Azure reverse
+// proxy, with the proxy's own upstream keys.
+func embed(ctx context.Context, model, text string) ([]float32, error) {
+	// A fresh context keeps the embeddings call out of the log line and
+	// metrics of the request it is made for, only the trace is carried on.
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx)), 10*time.Second)
+	defer cancel()
+	ctx, _ = azure.WithRequestInfo(azure.WithProxyKeys(ctx), "/v1/embeddings")
+
+	body, _ := json.Marshal(map[string]string{"model": model, "input": text})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	res := azure.NewResponseBuffer()
+	azureProxy.ServeHTTP(res, req)
+	if res.Status != http.StatusOK {
+		return nil, fmt.Errorf("embeddings request returned %d", res.Status)
+	}
 
-	return deployedModelsResponse.Data, nil
+	values := gjson.GetBytes(res.Body.Bytes(), "data.0.embedding").Array()
+	if len(values) == 0 {
+		return nil, fmt.Errorf("embeddings response has no embedding")
+	}
+	vector := make([]float32, len(values))
+	for i, v := range values {
+		vector[i] = float32(v.Float())
+	}
+	return vector, nil
 }
 
+// readRequestBody reads the whole request body and puts it back. When the
+// body can't be read, e.g. because it is over the limit, ok is false and the
+// proxy reports the error.
+func readRequestBody(c *gin.Context) (body []byte, ok bool) {
+	orig := c.Request.Body
+	body, err := io.ReadAll(orig)
+	if err != nil {
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), orig), orig}
+		return nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
 
-func handleAzureProxy(c *gin.Context) {
-	server := azure.NewOpenAIReverseProxy()
-	server.ServeHTTP(c.Writer, c.Request)
-	if c.Writer.Header().Get("Content-Type") == "text/event-stream" {
-		if _, err := c.Writer.Write([]byte("\n")); err != nil {
-			log.Printf("rewrite azure response error: %v", err)
+// queueRequest describes the request to the scheduler. The priority comes
+// from the caller's key, the x-proxy-priority header can only lower it.
+// Anonymous callers pick any priority with the header.
+func queueRequest(c *gin.Context, info *azure.RequestInfo) queue.Request {
+	r := queue.Request{Backend: info.Backend, Deployment: info.Deployment, Priority: queue.Normal, Weight: 1}
+	id := auth.FromContext(c.Request.Context())
+	if id != nil {
+		if p, ok := queue.ParsePriority(id.Priority); ok {
+			r.Priority = p
+		}
+		if id.Weight > 0 {
+			r.Weight = id.Weight
 		}
 	}
-	// Enhanced error logging
-	if c.Writer.Status() >= 400 {
-		log.Printf("Azure API request failed: %s %s, Status: %d", c.Request.Method, c.Request.URL.Path, c.Writer.Status())
+	if p, ok := queue.ParsePriority(c.GetHeader(queue.PriorityHeader)); ok && (id == nil || p > r.Priority) {
+		r.Priority = p
 	}
+	r.Flow = cache.KeyScope(id, c.GetHeader("api-key")+c.GetHeader("Authorization"))
+	return r
 }
 
-func handleOpenAIProxy(c *gin.Context) {
-	server := openai.NewOpenAIReverseProxy()
-	server.ServeHTTP(c.Writer, c.Request)
+// cacheScope returns the scope the caller's cached responses are kept in.
+func cacheScope(c *gin.Context) string {
+	return cache.ScopeOf(auth.FromContext(c.Request.Context()), c.GetHeader("api-key")+c.GetHeader("Authorization"))
+}
+
+// responseRecorder keeps a copy of what is written to the client, up to
+// limit bytes.
+type responseRecorder struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.buf.Len()+len(p) > r.limit {
+		r.overflow = true
+	} else if !r.overflow {
+		r.buf.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+// captureRequest reads the start of the request body for the audit log when
+// the caller has prompt capture enabled. The body is put back for the proxy.
+func captureRequest(c *gin.Context, info *azure.RequestInfo) json.RawMessage {
+	id := auth.FromContext(c.Request.Context())
+	if !audit.Enabled() || !(audit.CaptureAll || id != nil && id.CapturePrompts) || c.Request.Body == nil {
+		return nil
+	}
+	info.Capture = true
+
+	head, _ := io.ReadAll(io.LimitReader(c.Request.Body, int64(audit.CaptureLimit)+1))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), c.Request.Body), c.Request.Body}
+	if len(head) > audit.CaptureLimit {
+		return audit.Body(head[:audit.CaptureLimit], true)
+	}
+	return audit.Body(head, false)
+}
+
+// auditRequest queues the audit record of a finished request.
+func auditRequest(c *gin.Context, info *azure.RequestInfo, requestBody json.RawMessage) {
+	if !audit.Enabled() {
+		return
+	}
+	rec := &audit.Record{
+		Time:              info.Start,
+		RequestID:         logging.RequestID(c.Request.Context()),
+		UpstreamRequestID: info.UpstreamRequestID,
+		Region:            info.Region,
+		ClientIP:          c.ClientIP(),
+		Method:            c.Request.Method,
+		Route:             info.Route,
+		Model:             info.Model,
+		Deployment:        info.Deployment,
+		Backend:           info.Backend,
+		Stream:            strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream"),
+		Status:            c.Writer.Status(),
+		LatencyMS:         time.Since(info.Start).Milliseconds(),
+		PromptTokens:      info.Usage.PromptTokens,
+		CompletionTokens:  info.Usage.CompletionTokens,
+		ReasoningTokens:   info.Usage.ReasoningTokens,
+		TotalTokens:       info.Usage.TotalTokens,
+		Request:           requestBody,
+	}
+	if id := auth.FromContext(c.Request.Context()); id != nil {
+		rec.KeyID, rec.Subject, rec.Team, rec.AuthSource = id.ID, id.Subject, id.Team, id.Source
+	}
+	if info.Capture {
+		rec.Response = audit.Body(info.ResponseBody, info.ResponseTruncated)
+	}
+	audit.Log(rec)
 }
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/secrets"
+)
+
+var (
+	// Token is the bearer token required on every admin request.
+	Token *secrets.Value
+)
+
+func init() {
+	Token = secrets.NewValue(os.Getenv("AZURE_OPENAI_PROXY_ADMIN_TOKEN"))
+}
+
+// RequireToken rejects requests that don't carry the admin bearer token.
+func RequireToken(secret *secrets.Value) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		token := secret.Get()
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			apierror.Write(c.Writer, http.StatusUnauthorized, "invalid_request_error", "invalid_admin_token", "Invalid admin token")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/keys"
+	"github.com/gyarbij/azure-oai-proxy/pkg/queue"
+)
+
+// keyRequest is the body of create and update calls. Fields left out of an
+// update keep their current value.
+type keyRequest struct {
+	Name              *string    `json:"name"`
+	Owner             *string    `json:"owner"`
+	Team              *string    `json:"team"`
+	AllowedModels     *[]string  `json:"allowed_models"`
+	RequestsPerMinute *int       `json:"requests_per_minute"`
+	TokensPerMinute   *int       `json:"tokens_per_minute"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	CapturePrompts    *bool      `json:"capture_prompts"`
+	Priority          *string    `json:"priority"`
+	Weight            *int       `json:"weight"`
+}
+
+// keyWithSecret is returned by create and rotate, the only time the secret
+// is visible.
+type keyWithSecret struct {
+	*keys.Key
+	Secret string `json:"secret"`
+}
+
+func (r *keyRequest) validate() error {
+	if r.Priority != nil && *r.Priority != "" {
+		if _, ok := queue.ParsePriority(*r.Priority); !ok {
+			return errors.New("priority must be high, normal or low")
+		}
+	}
+	if r.Weight != nil && *r.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	return nil
+}
+
+func (r *keyRequest) apply(k *keys.Key) {
+	if r.Name != nil {
+		k.Name = *r.Name
+	}
+	if r.Owner != nil {
+		k.Owner = *r.Owner
+	}
+	if r.Team != nil {
+		k.Team = *r.Team
+	}
+	if r.AllowedModels != nil {
+		k.AllowedModels = *r.AllowedModels
+	}
+	if r.RequestsPerMinute != nil {
+		k.RequestsPerMinute = *r.RequestsPerMinute
+	}
+	if r.TokensPerMinute != nil {
+		k.TokensPerMinute = *r.TokensPerMinute
+	}
+	if r.ExpiresAt != nil {
+		k.ExpiresAt = r.ExpiresAt
+	}
+	if r.CapturePrompts != nil {
+		k.CapturePrompts = *r.CapturePrompts
+	}
+	if r.Priority != nil {
+		k.Priority = *r.Priority
+	}
+	if r.Weight != nil {
+		k.Weight = *r.Weight
+	}
+}
+
+// RegisterKeyRoutes adds the /keys management API to group.
+func RegisterKeyRoutes(group *gin.RouterGroup, store *keys.Store) {
+	h := &keyHandler{store: store}
+	group.POST("/keys", h.create)
+	group.GET("/keys", h.list)
+	group.GET("/keys/:id", h.get)
+	group.PATCH("/keys/:id", h.update)
+	group.POST("/keys/:id/rotate", h.rotate)
+	group.DELETE("/keys/:id", h.revoke)
+}
+
+type keyHandler struct {
+	store *keys.Store
+}
+
+func (h *keyHandler) create(c *gin.Context) {
+	var req keyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Write(c.Writer, http.StatusBadRequest, "invalid_request_error", "invalid_body", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		apierror.Write(c.Writer, http.StatusBadRequest, "invalid_request_error", "invalid_body", err.Error())
+		return
+	}
+	var k keys.Key
+	req.apply(&k)
+
+	created, secret, err := h.store.Create(k)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	log.Printf("Created virtual key %s (owner: %q, team: %q)", created.ID, created.Owner, created.Team)
+	c.JSON(http.StatusCreated, keyWithSecret{Key: created, Secret: secret})
+}
+
+func (h *keyHandler) list(c *gin.Context) {
+	list, err := h.store.List()
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": list})
+}
+
+func (h *keyHandler) get(c *gin.Context) {
+	k, err := h.store.Get(c.Param("id"))
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, k)
+}
+
+func (h *keyHandler) update(c *gin.Context) {
+	var req keyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apierror.Write(c.Writer, http.StatusBadRequest, "invalid_request_error", "invalid_body", err.Error())
+		return
+	}
+	if err := req.validate(); err != nil {
+		apierror.Write(c.Writer, http.StatusBadRequest, "invalid_request_error", "invalid_body", err.Error())
+		return
+	}
+	k, err := h.store.Update(c.Param("id"), req.apply)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	log.Printf("Updated virtual key %s", k.ID)
+	c.JSON(http.StatusOK, k)
+}
+
+func (h *keyHandler) rotate(c *gin.Context) {
+	k, secret, err := h.store.Rotate(c.Param("id"))
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	log.Printf("Rotated virtual key %s", k.ID)
+	c.JSON(http.StatusOK, keyWithSecret{Key: k, Secret: secret})
+}
+
+func (h *keyHandler) revoke(c *gin.Context) {
+	k, err := h.store.Revoke(c.Param("id"))
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	log.Printf("Revoked virtual key %s", k.ID)
+	c.JSON(http.StatusOK, k)
+}
+
+func storeError(c *gin.Context, err error) {
+	if errors.Is(err, keys.ErrNotFound) {
+		apierror.Write(c.Writer, http.StatusNotFound, "invalid_request_error", "key_not_found", err.Error())
+		return
+	}
+	log.Printf("Key store error: %v", err)
+	apierror.Write(c.Writer, http.StatusInternalServerError, "server_error", "key_store_error", "Key store error")
+}
@@ -0,0 +1,17 @@
+package admin
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed status.html
+var statusPage []byte
+
+// StatusPage serves the status page. It holds no data itself, the page asks
+// for the admin token and polls /admin/status with it.
+func StatusPage(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", statusPage)
+}
@@ -0,0 +1,31 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Body mirrors the OpenAI error envelope so clients can parse proxy errors
+// the same way they parse upstream ones.
+type Body struct {
+	Error Detail `json:"error"`
+}
+
+type Detail struct {
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// RequestIDHeader carries the request id to and from clients and upstream.
+const RequestIDHeader = "X-Request-ID"
+
+// Write sends an OpenAI-style JSON error response. The request id already
+// set on the response is repeated in the body.
+func Write(w http.ResponseWriter, status int, errType, code, message string) {
+	body, _ := json.Marshal(Body{Error: Detail{Message: message, Type: errType, Code: code, RequestID: w.Header().Get(RequestIDHeader)}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
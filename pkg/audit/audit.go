@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	// Target is where audit records go: "file:<path>" or an http(s) webhook
+	// URL. Auditing is disabled when empty.
+	Target = ""
+	// CaptureAll captures bodies for every caller, not only for keys that
+	// have capture_prompts set.
+	CaptureAll = false
+	// CaptureLimit bounds how many bytes of each body are captured.
+	CaptureLimit = 1 << 20
+)
+
+// Record is one audited request.
+type Record struct {
+	Time              time.Time `json:"time"`
+	RequestID         string    `json:"request_id,omitempty"`
+	UpstreamRequestID string    `json:"upstream_request_id,omitempty"`
+	Region            string    `json:"region,omitempty"`
+	KeyID             string    `json:"key_id,omitempty"`
+	Subject           string    `json:"subject,omitempty"`
+	Team              string    `json:"team,omitempty"`
+	AuthSource        string    `json:"auth_source,omitempty"`
+	ClientIP          string    `json:"client_ip,omitempty"`
+	Method            string    `json:"method"`
+	Route             string    `json:"route"`
+	Model             string    `json:"model,omitempty"`
+	Deployment        string    `json:"deployment,omitempty"`
+	Backend           string    `json:"backend,omitempty"`
+	Stream            bool      `json:"stream,omitempty"`
+	Status            int       `json:"status"`
+	LatencyMS         int64     `json:"latency_ms"`
+
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	ReasoningTokens  int `json:"reasoning_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens"`
+
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// Sink stores audit records. Write is called from a single goroutine with
+// batches of records.
+type Sink interface {
+	Write(ctx context.Context, records []*Record) error
+}
+
+// queue decouples request handling from the sink, requests never wait for
+// audit records to be written.
+var queue chan *Record
+
+func init() {
+	Target = os.Getenv("AZURE_OPENAI_PROXY_AUDIT")
+	if v, err := strconv.ParseBool(os.Getenv("AZURE_OPENAI_PROXY_AUDIT_CAPTURE")); err == nil {
+		CaptureAll = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_AUDIT_CAPTURE_MAX")); err == nil && v > 0 {
+		CaptureLimit = v
+	}
+}
+
+// Enabled reports whether audit records are collected.
+func Enabled() bool {
+	return queue != nil
+}
+
+// Start opens the sink configured by Target and starts writing records to
+// it. It does nothing when auditing is disabled.
+func Start(ctx context.Context) error {
+	if Target == "" {
+		return nil
+	}
+
+	var sink Sink
+	var err error
+	switch {
+	case strings.HasPrefix(Target, "file:"):
+		sink, err = NewFileSink(strings.TrimPrefix(Target, "file:"))
+	case strings.HasPrefix(Target, "http://"), strings.HasPrefix(Target, "https://"):
+		sink = NewWebhookSink(Target)
+	default:
+		err = fmt.Errorf("unknown audit target %q", Target)
+	}
+	if err != nil {
+		return err
+	}
+	StartSink(ctx, sink)
+	log.Printf("Audit log enabled: %s", Target)
+	return nil
+}
+
+// StartSink writes records to sink, for sinks other than the built-in ones.
+func StartSink(ctx context.Context, sink Sink) {
+	queue = make(chan *Record, 10000)
+	go run(ctx, sink)
+}
+
+// Log queues a record. When the sink falls behind and the queue is full the
+// record is dropped rather than slowing down requests.
+func Log(rec *Record) {
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- rec:
+	default:
+		metrics.AuditRecords.WithLabelValues("dropped").Inc()
+	}
+}
+
+// run hands records to the sink in batches of up to 100, at least once a
+// second.
+func run(ctx context.Context, sink Sink) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []*Record
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := sink.Write(ctx, batch); err != nil {
+			log.Printf("Error writing %d audit records: %v", len(batch), err)
+			metrics.AuditRecords.WithLabelValues("failed").Add(float64(len(batch)))
+		} else {
+			metrics.AuditRecords.WithLabelValues("written").Add(float64(len(batch)))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case rec := <-queue:
+			if batch = append(batch, rec); len(batch) >= 100 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			flush()
+			return
+		}
+	}
+}
+
+// Body converts a captured body for a record. JSON bodies are embedded as
+// they are, anything else (truncated JSON, SSE streams) as a string.
+func Body(data []byte, truncated bool) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if !truncated && json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	s := string(data)
+	if truncated {
+		s += "...(truncated)"
+	}
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// Capture passes body through unchanged and calls done with its first
+// CaptureLimit bytes once it has been read or closed.
+func Capture(body io.ReadCloser, done func(data []byte, truncated bool)) io.ReadCloser {
+	return &capture{body: body, done: done}
+}
+
+type capture struct {
+	body      io.ReadCloser
+	buf       bytes.Buffer
+	truncated bool
+	finished  bool
+	done      func([]byte, bool)
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 {
+		if room := CaptureLimit - c.buf.Len(); room < n {
+			c.buf.Write(p[:max(room, 0)])
+			c.truncated = true
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *capture) Close() error {
+	c.finish()
+	return c.body.Close()
+}
+
+func (c *capture) finish() {
+	if !c.finished {
+		c.finished = true
+		c.done(c.buf.Bytes(), c.truncated)
+	}
+}
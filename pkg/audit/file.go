@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// MaxFileSize rotates the audit file once it grows past this many bytes.
+	MaxFileSize int64 = 100 << 20
+	// RotateInterval rotates the audit file after this long regardless of
+	// its size.
+	RotateInterval = 24 * time.Hour
+	// MaxFiles is how many rotated files are kept, zero keeps all of them.
+	MaxFiles = 0
+)
+
+func init() {
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_AUDIT_MAX_SIZE_MB")); err == nil && v > 0 {
+		MaxFileSize = int64(v) << 20
+	}
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_AUDIT_ROTATE")); err == nil && v > 0 {
+		RotateInterval = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_AUDIT_MAX_FILES")); err == nil && v >= 0 {
+		MaxFiles = v
+	}
+}
+
+// FileSink appends records as JSON lines to a file. Rotated files get the
+// rotation time inserted before their extension, audit.jsonl becomes
+// audit-20250102T150405.000.jsonl.
+type FileSink struct {
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewFileSink opens path for appending, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	s := &FileSink{path: path}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size, s.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (s *FileSink) Write(ctx context.Context, records []*Record) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	if s.size > 0 && (s.size+int64(buf.Len()) > MaxFileSize || time.Since(s.opened) >= RotateInterval) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	if err := os.Rename(s.path, base+"-"+time.Now().UTC().Format("20060102T150405.000")+ext); err != nil {
+		return err
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	if MaxFiles > 0 {
+		rotated, _ := filepath.Glob(base + "-*" + ext)
+		sort.Strings(rotated)
+		for len(rotated) > MaxFiles {
+			if err := os.Remove(rotated[0]); err != nil {
+				log.Printf("Error removing old audit file: %v", err)
+			}
+			rotated = rotated[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/secrets"
+)
+
+// WebhookToken is sent as a bearer token to the audit webhook, if set.
+var WebhookToken *secrets.Value
+
+func init() {
+	WebhookToken = secrets.NewValue(os.Getenv("AZURE_OPENAI_PROXY_AUDIT_WEBHOOK_TOKEN"))
+}
+
+// WebhookSink POSTs batches of records as newline-delimited JSON.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *WebhookSink) Write(ctx context.Context, records []*Record) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if token := WebhookToken.Get(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
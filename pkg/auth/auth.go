@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+)
+
+var (
+	// Mode is a comma-separated list of auth modes tried in order. The
+	// default "passthrough" forwards client credentials to Azure untouched.
+	Mode = "passthrough"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// nothing it understands, so the next configured mode can try.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator resolves the caller of a request to an Identity.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Identity, error)
+}
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_AUTH_MODE"); v != "" {
+		Mode = v
+	}
+	log.Printf("loading azure openai proxy auth mode: %s", Mode)
+}
+
+// Passthrough reports whether passthrough is one of the configured modes.
+// Combined with other modes, requests that carry no credentials those
+// understand are forwarded with their own, as without any other mode.
+func Passthrough() bool {
+	for _, m := range strings.Split(Mode, ",") {
+		if strings.ToLower(strings.TrimSpace(m)) == "passthrough" {
+			return true
+		}
+	}
+	return false
+}
+
+// Modes returns the configured auth modes, excluding passthrough.
+func Modes() []string {
+	var modes []string
+	for _, m := range strings.Split(Mode, ",") {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if m != "" && m != "passthrough" {
+			modes = append(modes, m)
+		}
+	}
+	return modes
+}
+
+// Middleware authenticates requests with the given authenticators and
+// enforces per-identity limits. With no authenticators every request passes
+// through unchanged, with passthrough among the modes every request without
+// proxy credentials does.
+func Middleware(authenticators ...Authenticator) gin.HandlerFunc {
+	if len(authenticators) == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	passthrough := Passthrough()
+
+	return func(c *gin.Context) {
+		for _, a := range authenticators {
+			id, err := a.Authenticate(c.Request)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				logging.FromContext(c.Request.Context()).Warn("authentication failed", "error", err)
+				apierror.Write(c.Writer, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "Invalid credentials")
+				c.Abort()
+				return
+			}
+
+			if err := Limits.Allow(id); err != nil {
+				apierror.Write(c.Writer, http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded", err.Error())
+				c.Abort()
+				return
+			}
+
+			logging.AddAttrs(c.Request.Context(), "key_id", id.ID)
+			c.Request = c.Request.WithContext(WithIdentity(c.Request.Context(), id))
+			c.Next()
+			return
+		}
+
+		if passthrough {
+			c.Next()
+			return
+		}
+		apierror.Write(c.Writer, http.StatusUnauthorized, "invalid_request_error", "missing_api_key", "Missing credentials")
+		c.Abort()
+	}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
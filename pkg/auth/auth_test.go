@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerAuthenticator accepts "x-test-key: good" and rejects other values.
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	switch req.Header.Get("x-test-key") {
+	case "":
+		return nil, ErrNoCredentials
+	case "good":
+		return &Identity{ID: "test:good"}, nil
+	}
+	return nil, errors.New("bad key")
+}
+
+func TestMiddlewarePassthrough(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		mode, key string
+		status    int
+		identity  bool
+	}{
+		{"keys", "good", http.StatusOK, true},
+		{"keys", "", http.StatusUnauthorized, false},
+		{"keys", "bad", http.StatusUnauthorized, false},
+		{"keys,passthrough", "good", http.StatusOK, true},
+		{"keys,passthrough", "", http.StatusOK, false},
+		{"keys,passthrough", "bad", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.key, func(t *testing.T) {
+			defer func(m string) { Mode = m }(Mode)
+			Mode = tt.mode
+
+			r := gin.New()
+			var identity bool
+			r.Use(Middleware(headerAuthenticator{}))
+			r.GET("/", func(c *gin.Context) {
+				identity = FromContext(c.Request.Context()) != nil
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.key != "" {
+				req.Header.Set("x-test-key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status || identity != tt.identity {
+				t.Fatalf("status %d, identity %v, want %d, %v", w.Code, identity, tt.status, tt.identity)
+			}
+		})
+	}
+}
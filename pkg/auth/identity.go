@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"strings"
+)
+
+// Identity is the authenticated caller of a proxied request. Every auth mode
+// (JWT, virtual keys, ...) resolves to one so permissions and limits are
+// enforced the same way regardless of how the caller proved who they are.
+type Identity struct {
+	ID      string // stable identifier used for limits, e.g. "jwt:<sub>"
+	Subject string
+	Team    string
+	Source  string // auth mode that produced the identity
+
+	// AllowedModels restricts which models the caller may use. Empty means all.
+	AllowedModels []string
+
+	// Per-minute limits, zero means unlimited.
+	RequestsPerMinute int
+	TokensPerMinute   int
+
+	// CapturePrompts adds request and response bodies to the caller's audit
+	// records.
+	CapturePrompts bool
+
+	// Priority is the scheduling class of the caller's requests: "high",
+	// "normal" or "low", empty is normal. Weight is the caller's share of
+	// capacity against others of the same class, zero counts as 1.
+	Priority string
+	Weight   int
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx, or nil when the request was
+// not authenticated by the proxy (passthrough mode).
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// AllowsModel reports whether the identity may call model. Entries ending in
+// "*" match by prefix, matching is case-insensitive.
+func (i *Identity) AllowsModel(model string) bool {
+	if len(i.AllowedModels) == 0 {
+		return true
+	}
+	model = strings.ToLower(model)
+	for _, m := range i.AllowedModels {
+		m = strings.ToLower(m)
+		if m == "*" || m == model {
+			return true
+		}
+		if strings.HasSuffix(m, "*") && strings.HasPrefix(model, strings.TrimSuffix(m, "*")) {
+			return true
+		}
+	}
+	return false
+}
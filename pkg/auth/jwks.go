@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// minRefetchInterval bounds how often an unknown kid can force a refetch, so
+// garbage tokens cannot be used to hammer the identity provider.
+const minRefetchInterval = time.Minute
+
+// KeySet caches the public keys of a JWKS document loaded from a URL or a
+// local file. Keys are refreshed periodically and whenever a token references
+// a kid that is not in the cache, which covers provider key rotation.
+type KeySet struct {
+	url     string
+	file    string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]any
+	fetchedAt   time.Time
+	fileModTime time.Time
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// NewKeySet creates a key set backed by url or, when url is empty, by file.
+func NewKeySet(url, file string, refresh time.Duration) (*KeySet, error) {
+	if url == "" && file == "" {
+		return nil, fmt.Errorf("either a JWKS URL or a JWKS file is required")
+	}
+	ks := &KeySet{
+		url:     url,
+		file:    file,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    make(map[string]any),
+	}
+	if err := ks.load(); err != nil {
+		if url == "" {
+			return nil, err
+		}
+		// The identity provider may come up after the proxy, tokens will
+		// trigger another fetch once minRefetchInterval has passed.
+		log.Printf("Error fetching JWKS, will retry: %v", err)
+	}
+	return ks, nil
+}
+
+// Key returns the public key for kid. An empty kid matches the only key of a
+// single-key set.
+func (ks *KeySet) Key(kid string) (any, error) {
+	ks.maybeRefresh(false)
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+
+	ks.maybeRefresh(true)
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (ks *KeySet) lookup(kid string) (any, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func (ks *KeySet) maybeRefresh(force bool) {
+	ks.mu.RLock()
+	age := time.Since(ks.fetchedAt)
+	ks.mu.RUnlock()
+
+	if ks.file != "" && ks.url == "" {
+		// Local files are cheap to stat, reload whenever they change.
+		if info, err := os.Stat(ks.file); err == nil && !info.ModTime().Equal(ks.modTime()) {
+			ks.reload()
+		}
+		return
+	}
+	if (force && age >= minRefetchInterval) || age >= ks.refresh {
+		ks.reload()
+	}
+}
+
+func (ks *KeySet) reload() {
+	if err := ks.load(); err != nil {
+		// Keep serving the previous keys, a transient IdP outage should not
+		// reject every token.
+		log.Printf("Error refreshing JWKS: %v", err)
+	}
+}
+
+func (ks *KeySet) modTime() time.Time {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.fileModTime
+}
+
+func (ks *KeySet) load() error {
+	var data []byte
+	var modTime time.Time
+	if ks.url != "" {
+		resp, err := ks.client.Get(ks.url)
+		if err != nil {
+			ks.markFetched()
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			ks.markFetched()
+			return fmt.Errorf("fetching JWKS from %s: status %d", ks.url, resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			ks.markFetched()
+			return err
+		}
+	} else {
+		info, err := os.Stat(ks.file)
+		if err != nil {
+			return err
+		}
+		if data, err = os.ReadFile(ks.file); err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+	}
+
+	keys, err := parseJWKS(data, ks.url != "")
+	if err != nil {
+		ks.markFetched()
+		return err
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	ks.fileModTime = modTime
+	ks.mu.Unlock()
+	log.Printf("Loaded %d JWKS signing keys", len(keys))
+	return nil
+}
+
+// markFetched records a failed attempt so retries respect the refetch bounds.
+func (ks *KeySet) markFetched() {
+	ks.mu.Lock()
+	ks.fetchedAt = time.Now()
+	ks.mu.Unlock()
+}
+
+// parseJWKS returns the signing keys of a JWKS document. Key sets fetched
+// over the network are limited to RSA and EC keys, anyone who can tamper
+// with the response must not be able to add a key to sign tokens with.
+func parseJWKS(data []byte, remote bool) (map[string]any, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	keys := make(map[string]any)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if remote && k.Kty != "RSA" && k.Kty != "EC" {
+			log.Printf("Skipping JWKS key %q: key type %q is only accepted from a file", k.Kid, k.Kty)
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		// Symmetric keys are only accepted from a file, for testing.
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
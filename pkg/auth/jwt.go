@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTConfig configures validation of inbound OIDC access tokens.
+type JWTConfig struct {
+	JWKSURL        string
+	JWKSFile       string
+	JWKSRefresh    time.Duration
+	Issuer         string
+	Audience       string
+	RequiredScopes []string
+	RequiredGroups []string // the token must carry at least one of these
+	Leeway         time.Duration
+
+	// Claims mapped onto the Identity.
+	SubjectClaim  string
+	ModelsClaim   string
+	RPMClaim      string
+	TPMClaim      string
+	PriorityClaim string
+}
+
+// JWT is the configuration loaded from the environment.
+var JWT = JWTConfig{
+	JWKSRefresh:   time.Hour,
+	Leeway:        30 * time.Second,
+	SubjectClaim:  "sub",
+	ModelsClaim:   "models",
+	RPMClaim:      "rpm",
+	TPMClaim:      "tpm",
+	PriorityClaim: "priority",
+}
+
+func init() {
+	JWT.JWKSURL = os.Getenv("AZURE_OPENAI_PROXY_JWT_JWKS_URL")
+	JWT.JWKSFile = os.Getenv("AZURE_OPENAI_PROXY_JWT_JWKS_FILE")
+	JWT.Issuer = os.Getenv("AZURE_OPENAI_PROXY_JWT_ISSUER")
+	JWT.Audience = os.Getenv("AZURE_OPENAI_PROXY_JWT_AUDIENCE")
+	JWT.RequiredScopes = splitList(os.Getenv("AZURE_OPENAI_PROXY_JWT_REQUIRED_SCOPES"))
+	JWT.RequiredGroups = splitList(os.Getenv("AZURE_OPENAI_PROXY_JWT_REQUIRED_GROUPS"))
+	if v := os.Getenv("AZURE_OPENAI_PROXY_JWT_JWKS_REFRESH"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			JWT.JWKSRefresh = d
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_JWT_SUBJECT_CLAIM"); v != "" {
+		JWT.SubjectClaim = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_JWT_MODELS_CLAIM"); v != "" {
+		JWT.ModelsClaim = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_JWT_RPM_CLAIM"); v != "" {
+		JWT.RPMClaim = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_JWT_TPM_CLAIM"); v != "" {
+		JWT.TPMClaim = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_JWT_PRIORITY_CLAIM"); v != "" {
+		JWT.PriorityClaim = v
+	}
+}
+
+// JWTAuthenticator validates "Authorization: Bearer <jwt>" against a JWKS.
+type JWTAuthenticator struct {
+	cfg    JWTConfig
+	keys   *KeySet
+	parser *jwt.Parser
+}
+
+func NewJWTAuthenticator(cfg JWTConfig) (*JWTAuthenticator, error) {
+	keys, err := NewKeySet(cfg.JWKSURL, cfg.JWKSFile, cfg.JWKSRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+	if cfg.JWKSURL == "" {
+		// Ed25519 and HMAC keys can only come from a local JWKS file.
+		methods = append(methods, "EdDSA", "HS256", "HS384", "HS512")
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	log.Printf("JWT authentication enabled (issuer: %q, audience: %q)", cfg.Issuer, cfg.Audience)
+	return &JWTAuthenticator{cfg: cfg, keys: keys, parser: jwt.NewParser(opts...)}, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	raw := bearerToken(req)
+	// Anything that is not a three-part token is left to other auth modes.
+	if strings.Count(raw, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := a.keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Never let an HMAC token be verified with a public key's bytes.
+		if _, symmetric := key.([]byte); symmetric != strings.HasPrefix(t.Method.Alg(), "HS") {
+			return nil, fmt.Errorf("algorithm %s does not match key %q", t.Method.Alg(), kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.checkScopes(claims); err != nil {
+		return nil, err
+	}
+	if err := a.checkGroups(claims); err != nil {
+		return nil, err
+	}
+
+	subject := claimString(claims, a.cfg.SubjectClaim)
+	if subject == "" {
+		return nil, fmt.Errorf("token has no %q claim", a.cfg.SubjectClaim)
+	}
+
+	return &Identity{
+		ID:                "jwt:" + subject,
+		Subject:           subject,
+		Source:            "jwt",
+		AllowedModels:     claimList(claims, a.cfg.ModelsClaim),
+		RequestsPerMinute: claimInt(claims, a.cfg.RPMClaim),
+		TokensPerMinute:   claimInt(claims, a.cfg.TPMClaim),
+		Priority:          claimString(claims, a.cfg.PriorityClaim),
+	}, nil
+}
+
+func (a *JWTAuthenticator) checkScopes(claims jwt.MapClaims) error {
+	if len(a.cfg.RequiredScopes) == 0 {
+		return nil
+	}
+	// Azure AD uses "scp", most other providers use "scope".
+	have := toSet(append(claimList(claims, "scp"), claimList(claims, "scope")...))
+	for _, s := range a.cfg.RequiredScopes {
+		if !have[s] {
+			return fmt.Errorf("token is missing required scope %q", s)
+		}
+	}
+	return nil
+}
+
+func (a *JWTAuthenticator) checkGroups(claims jwt.MapClaims) error {
+	if len(a.cfg.RequiredGroups) == 0 {
+		return nil
+	}
+	have := toSet(append(claimList(claims, "groups"), claimList(claims, "roles")...))
+	for _, g := range a.cfg.RequiredGroups {
+		if have[g] {
+			return nil
+		}
+	}
+	return fmt.Errorf("token is not a member of any required group")
+}
+
+func claimString(claims jwt.MapClaims, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// claimList accepts both JSON arrays and space- or comma-separated strings.
+func claimList(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return splitList(v)
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func claimInt(claims jwt.MapClaims, name string) int {
+	switch v := claims[name].(type) {
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testdata/jwks.json holds the public half of testdata/rsa.pem as kid "rsa"
+// and hmacSecret as kid "hmac".
+const hmacSecret = "test-secret-for-hmac-tokens-only"
+
+func testConfig() JWTConfig {
+	cfg := JWT
+	cfg.JWKSURL = ""
+	cfg.JWKSFile = "testdata/jwks.json"
+	cfg.Issuer = "https://issuer.test"
+	cfg.Audience = "azure-oai-proxy"
+	cfg.Leeway = 0
+	return cfg
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	data, err := os.ReadFile("testdata/rsa.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "alice",
+		"iss": "https://issuer.test",
+		"aud": "azure-oai-proxy",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"rpm": 60,
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func authenticate(a *JWTAuthenticator, token string) (*Identity, error) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return a.Authenticate(req)
+}
+
+func TestJWTFromFile(t *testing.T) {
+	a, err := NewJWTAuthenticator(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := rsaKey(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(name string, v any) jwt.MapClaims {
+		c := validClaims()
+		if v == nil {
+			delete(c, name)
+		} else {
+			c[name] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"rsa", sign(t, jwt.SigningMethodRS256, "rsa", key, validClaims()), true},
+		{"hmac", sign(t, jwt.SigningMethodHS256, "hmac", []byte(hmacSecret), validClaims()), true},
+		{"wrong signature", sign(t, jwt.SigningMethodRS256, "rsa", other, validClaims()), false},
+		{"wrong hmac secret", sign(t, jwt.SigningMethodHS256, "hmac", []byte("guessed"), validClaims()), false},
+		{"unknown kid", sign(t, jwt.SigningMethodRS256, "nope", key, validClaims()), false},
+		{"rsa key as hmac secret", sign(t, jwt.SigningMethodHS256, "rsa", []byte(hmacSecret), validClaims()), false},
+		{"wrong audience", sign(t, jwt.SigningMethodRS256, "rsa", key, with("aud", "someone-else")), false},
+		{"wrong issuer", sign(t, jwt.SigningMethodRS256, "rsa", key, with("iss", "https://evil.test")), false},
+		{"expired", sign(t, jwt.SigningMethodRS256, "rsa", key, with("exp", time.Now().Add(-time.Minute).Unix())), false},
+		{"no expiry", sign(t, jwt.SigningMethodRS256, "rsa", key, with("exp", nil)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := authenticate(a, tt.token)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				if id.Subject != "alice" || id.RequestsPerMinute != 60 {
+					t.Fatalf("identity = %+v", id)
+				}
+			} else if err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+func TestJWTRemoteKeySetRejectsSymmetricKeys(t *testing.T) {
+	jwks, err := os.ReadFile("testdata/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	cfg := testConfig()
+	cfg.JWKSURL = srv.URL
+	a, err := NewJWTAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(a, sign(t, jwt.SigningMethodRS256, "rsa", rsaKey(t), validClaims())); err != nil {
+		t.Fatalf("rsa token rejected: %v", err)
+	}
+	if _, err := authenticate(a, sign(t, jwt.SigningMethodHS256, "hmac", []byte(hmacSecret), validClaims())); err == nil {
+		t.Fatal("hmac token accepted with a remote key set")
+	}
+	if _, ok := a.keys.lookup("hmac"); ok {
+		t.Fatal("oct key loaded from a remote key set")
+	}
+}
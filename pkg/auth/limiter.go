@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRequestLimit = errors.New("request rate limit exceeded")
+	ErrTokenLimit   = errors.New("token rate limit exceeded")
+)
+
+// Limits is the process-wide limiter shared by all auth modes.
+var Limits = NewLimiter()
+
+// Limiter enforces per-identity requests and tokens per minute using fixed
+// one-minute windows.
+type Limiter struct {
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+type window struct {
+	start    time.Time
+	requests int
+	tokens   int
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{windows: make(map[string]*window)}
+}
+
+// Allow counts a request against id and returns an error when one of its
+// limits is already used up for the current minute.
+func (l *Limiter) Allow(id *Identity) error {
+	if id.RequestsPerMinute <= 0 && id.TokensPerMinute <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w := l.current(id.ID)
+	if id.TokensPerMinute > 0 && w.tokens >= id.TokensPerMinute {
+		return ErrTokenLimit
+	}
+	if id.RequestsPerMinute > 0 && w.requests >= id.RequestsPerMinute {
+		return ErrRequestLimit
+	}
+	w.requests++
+	return nil
+}
+
+// RecordTokens adds tokens consumed by a finished request to id's window.
+func (l *Limiter) RecordTokens(id *Identity, tokens int) {
+	if id.TokensPerMinute <= 0 || tokens <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current(id.ID).tokens += tokens
+}
+
+func (l *Limiter) current(key string) *window {
+	now := time.Now()
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		if len(l.windows) > 10000 {
+			l.prune(now)
+		}
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+	return w
+}
+
+func (l *Limiter) prune(now time.Time) {
+	for k, w := range l.windows {
+		if now.Sub(w.start) >= time.Minute {
+			delete(l.windows, k)
+		}
+	}
+}
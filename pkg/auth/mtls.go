@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+var (
+	// MTLSPolicyFile maps client certificate subjects to permissions.
+	MTLSPolicyFile = ""
+)
+
+// Policy is the set of permissions and limits granted to an identity that
+// doesn't carry them itself, such as a client certificate.
+type Policy struct {
+	AllowedModels     []string `json:"allowed_models"`
+	RequestsPerMinute int      `json:"requests_per_minute"`
+	TokensPerMinute   int      `json:"tokens_per_minute"`
+	CapturePrompts    bool     `json:"capture_prompts"`
+	Priority          string   `json:"priority"`
+	Weight            int      `json:"weight"`
+}
+
+func init() {
+	MTLSPolicyFile = os.Getenv("AZURE_OPENAI_PROXY_MTLS_POLICY_FILE")
+}
+
+// MTLSAuthenticator identifies callers by the client certificate verified
+// during the TLS handshake. The subject is the certificate's common name, or
+// its first URI SAN (e.g. a SPIFFE ID) when the common name is empty.
+type MTLSAuthenticator struct {
+	policies map[string]Policy // by subject, "*" applies to everyone else
+}
+
+// NewMTLSAuthenticator loads the policy file, if any. Without a policy file
+// every verified certificate is allowed without restrictions, with one only
+// listed subjects (or "*") are.
+func NewMTLSAuthenticator(policyFile string) (*MTLSAuthenticator, error) {
+	a := &MTLSAuthenticator{}
+	if policyFile != "" {
+		data, err := os.ReadFile(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &a.policies); err != nil {
+			return nil, fmt.Errorf("parsing mTLS policy file: %w", err)
+		}
+		log.Printf("Loaded mTLS policies for %d subjects", len(a.policies))
+	}
+	return a, nil
+}
+
+func (a *MTLSAuthenticator) Authenticate(req *http.Request) (*Identity, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	subject := cert.Subject.CommonName
+	if subject == "" && len(cert.URIs) > 0 {
+		subject = cert.URIs[0].String()
+	}
+	if subject == "" {
+		return nil, errors.New("client certificate has no subject")
+	}
+
+	id := &Identity{ID: "mtls:" + subject, Subject: subject, Source: "mtls"}
+	if a.policies == nil {
+		return id, nil
+	}
+	policy, ok := a.policies[subject]
+	if !ok {
+		if policy, ok = a.policies["*"]; !ok {
+			return nil, fmt.Errorf("client certificate %q is not authorized", subject)
+		}
+	}
+	id.AllowedModels = policy.AllowedModels
+	id.RequestsPerMinute = policy.RequestsPerMinute
+	id.TokensPerMinute = policy.TokensPerMinute
+	id.CapturePrompts = policy.CapturePrompts
+	id.Priority = policy.Priority
+	id.Weight = policy.Weight
+	return id, nil
+}
@@ -0,0 +1,297 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// Balance is how requests are spread over the backends that can serve
+	// them: "ordered" keeps them on AZURE_OPENAI_ENDPOINT,
+	// "least_outstanding" picks the backend with the fewest requests in
+	// flight, "latency" the one with the lowest average upstream latency and
+	// "affinity" sends requests with the same prompt prefix to the same
+	// backend, so Azure's prompt cache hits.
+	Balance = "ordered"
+	// BalanceMinTokens moves backends that report fewer remaining tokens for
+	// the deployment behind all others, whatever the strategy.
+	BalanceMinTokens int64 = 1000
+	// BalanceProbeInterval is how often backends without traffic are probed
+	// to keep their latency current. Off when 0.
+	BalanceProbeInterval time.Duration
+	// AffinityPrefixTokens is how many tokens of the messages, after the
+	// system prompt, make up the prefix under "affinity".
+	AffinityPrefixTokens = 128
+	// AffinityLoadFactor is how far above the average number of requests in
+	// flight a backend may go under "affinity" before its requests move on
+	// to the next backend.
+	AffinityLoadFactor = 1.25
+)
+
+const (
+	// latencyWeight is the weight of a new sample in the moving average.
+	latencyWeight = 0.2
+	// errorLatency is the sample recorded for a failed or throttled
+	// request, so a backend answering errors quickly doesn't look fast.
+	errorLatency = 10 * time.Second
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_BALANCE"); v != "" {
+		switch v {
+		case "ordered", "least_outstanding", "latency", "affinity":
+			Balance = v
+		default:
+			log.Printf("Invalid AZURE_OPENAI_PROXY_BALANCE %q, using %s", v, Balance)
+		}
+	}
+	if v, err := strconv.ParseInt(os.Getenv("AZURE_OPENAI_PROXY_BALANCE_MIN_TOKENS"), 10, 64); err == nil && v >= 0 {
+		BalanceMinTokens = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_BALANCE_PROBE_INTERVAL")); err == nil && v > 0 {
+		BalanceProbeInterval = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_AFFINITY_PREFIX_TOKENS")); err == nil && v > 0 {
+		AffinityPrefixTokens = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("AZURE_OPENAI_PROXY_AFFINITY_LOAD_FACTOR"), 64); err == nil && v >= 1 {
+		AffinityLoadFactor = v
+	}
+}
+
+// backendLatency is the moving average of a backend's upstream latency.
+type backendLatency struct {
+	avg  float64   // seconds
+	live time.Time // of the last sample from a proxied request
+}
+
+var (
+	latencyMu sync.Mutex
+	latencies = map[string]*backendLatency{}
+)
+
+// recordLatency adds a sample to the backend's moving average.
+func recordLatency(backend string, d time.Duration, live bool) {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	l, ok := latencies[backend]
+	if !ok {
+		l = &backendLatency{avg: d.Seconds()}
+		latencies[backend] = l
+	} else {
+		l.avg += latencyWeight * (d.Seconds() - l.avg)
+	}
+	if live {
+		l.live = time.Now()
+	}
+}
+
+// observeLatency records the time until upstream answered. Failures and
+// throttling count as errorLatency.
+func observeLatency(info *RequestInfo, status int) {
+	d := time.Since(info.UpstreamStart)
+	if status == http.StatusTooManyRequests || status >= 500 {
+		d = max(d, errorLatency)
+	}
+	recordLatency(info.Backend, d, true)
+}
+
+// rank orders backends by the Balance strategy. Backends without a
+// measurement yet come first under "latency", so they get one. Under
+// "affinity" the prefix picks the order by rendezvous hashing, so a prefix
+// keeps its backend as regions come and go, and backends over their share
+// of the requests in flight go last. Requests without a prefix go to the
+// least busy backend. Ties keep the configured order.
+func rank(backends []string, deployment, affinity string) []string {
+	type candidate struct {
+		name  string
+		low   bool // nearly out of tokens
+		busy  bool
+		score float64
+	}
+	cs := make([]candidate, len(backends))
+	var total int64
+	for i, b := range backends {
+		remaining, ok := RemainingTokens(b, deployment)
+		cs[i] = candidate{name: b, low: ok && remaining < BalanceMinTokens}
+		total += inflightCount(b)
+	}
+	// Consistent hashing with bounded loads: each backend takes at most its
+	// share of the requests in flight, this one included, times the factor.
+	bound := math.Ceil(AffinityLoadFactor * float64(total+1) / float64(len(backends)))
+
+	latencyMu.Lock()
+	for i := range cs {
+		c := &cs[i]
+		switch Balance {
+		case "least_outstanding":
+			c.score = float64(inflightCount(c.name))
+		case "latency":
+			if l, ok := latencies[c.name]; ok {
+				c.score = l.avg
+			}
+		case "affinity":
+			n := inflightCount(c.name)
+			c.busy = float64(n+1) > bound
+			if affinity == "" {
+				c.score = float64(n)
+			} else {
+				h := fnv.New64a()
+				h.Write([]byte(affinity + "\x00" + c.name))
+				c.score = -float64(h.Sum64())
+			}
+		}
+	}
+	latencyMu.Unlock()
+
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := cs[i], cs[j]
+		if a.low != b.low {
+			return b.low
+		}
+		if a.busy != b.busy {
+			return b.busy
+		}
+		return a.score < b.score
+	})
+	for i, c := range cs {
+		backends[i] = c.name
+	}
+	return backends
+}
+
+// PickBackend returns the backend a request for model is sent to. Under
+// "affinity" balancing the prompt is only looked at when there is a choice.
+func PickBackend(req *http.Request, model string) string {
+	backends := Backends(req, model)
+	if Balance == "affinity" && len(backends) > 1 && hasPrompt(req) {
+		RequestInfoFromContext(req.Context()).Affinity = affinityKey(req, model)
+		backends = Backends(req, model)
+	}
+	return backends[0]
+}
+
+// hasPrompt reports whether req is a JSON request of a route with a prompt
+// that upstream may cache.
+func hasPrompt(req *http.Request) bool {
+	switch RequestInfoFromContext(req.Context()).Route {
+	case "/v1/chat/completions", "/v1/completions", "/v1/responses":
+	default:
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// affinityKey identifies requests that share a prompt prefix: by the
+// client's prompt_cache_key or user, or else by the system prompt and the
+// first AffinityPrefixTokens tokens of the other messages. Longer prefixes
+// only split up conversations, whose later turns start the same.
+// Only the start of the body, up to ModelPeekLimit, is read.
+func affinityKey(req *http.Request, model string) string {
+	body := peekBody(req, ModelPeekLimit)
+	for _, field := range []string{"prompt_cache_key", "user"} {
+		if v := gjson.GetBytes(body, field).String(); v != "" {
+			return field + ":" + v
+		}
+	}
+
+	h := fnv.New64a()
+	var rest strings.Builder
+	h.Write([]byte(gjson.GetBytes(body, "instructions").Raw))
+	for _, m := range gjson.GetBytes(body, "messages").Array() {
+		if role := m.Get("role").String(); role == "system" || role == "developer" {
+			h.Write([]byte(m.Raw))
+		} else {
+			rest.WriteString(m.Raw)
+		}
+	}
+	for _, field := range []string{"prompt", "input"} {
+		rest.WriteString(gjson.GetBytes(body, field).Raw)
+	}
+	// Tokens average well under 8 bytes, more text than this isn't needed.
+	text := rest.String()
+	text = text[:min(len(text), AffinityPrefixTokens*8)]
+	if enc := encodingFor(model); enc != nil {
+		tokens := enc.EncodeOrdinary(text)
+		for _, t := range tokens[:min(len(tokens), AffinityPrefixTokens)] {
+			h.Write([]byte{byte(t), byte(t >> 8), byte(t >> 16), byte(t >> 24)})
+		}
+	} else {
+		h.Write([]byte(text[:min(len(text), AffinityPrefixTokens*4)]))
+	}
+	return fmt.Sprintf("prefix:%x", h.Sum64())
+}
+
+// StartBalanceProbes probes the Azure backends that had no traffic for
+// BalanceProbeInterval, so "latency" balancing doesn't go by an old
+// measurement. The probe is the readiness check of the first deployment,
+// which Azure rejects before any inference.
+func StartBalanceProbes(ctx context.Context, deployments []string) {
+	if Balance != "latency" || BalanceProbeInterval == 0 || len(Regions) == 0 || len(deployments) == 0 {
+		return
+	}
+	deployment := deployments[0]
+	go func() {
+		ticker := time.NewTicker(BalanceProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, b := range append([]string{"azure"}, regionNames()...) {
+				latencyMu.Lock()
+				l, ok := latencies[b]
+				idle := !ok || time.Since(l.live) >= BalanceProbeInterval
+				latencyMu.Unlock()
+				if idle {
+					probeLatency(ctx, b, deployment)
+				}
+			}
+		}
+	}()
+}
+
+func probeLatency(ctx context.Context, backend, deployment string) {
+	ctx, cancel := context.WithTimeout(ctx, errorLatency)
+	defer cancel()
+	endpoint, pool := azureEndpoint(backend)
+	u := fmt.Sprintf("%s%s?api-version=%s", strings.TrimSuffix(endpoint, "/"), path.Join("/openai/deployments", deployment, "chat/completions"), AzureOpenAIAPIVersion)
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(`{"messages":[]}`))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api-key", pool.Next())
+	start := time.Now()
+	status, err := probe(req)
+	if err != nil || status != http.StatusBadRequest {
+		recordLatency(backend, errorLatency, false)
+		return
+	}
+	recordLatency(backend, time.Since(start), false)
+}
+
+func regionNames() []string {
+	names := make([]string, len(Regions))
+	for i, r := range Regions {
+		names[i] = r.Name
+	}
+	return names
+}
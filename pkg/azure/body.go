@@ -0,0 +1,132 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/bodylimit"
+	"github.com/tidwall/gjson"
+)
+
+// ModelPeekLimit bounds how much of a body is read to find the model. JSON
+// bodies are read up to the model field, which SDKs often send after the
+// messages, multipart bodies up to the model field or the first file.
+var ModelPeekLimit int64 = 32 << 20
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MODEL_PEEK_MAX"); v != "" {
+		if n, err := bodylimit.ParseSize(v); err == nil {
+			ModelPeekLimit = n
+		} else {
+			log.Printf("Invalid AZURE_OPENAI_PROXY_MODEL_PEEK_MAX: %v", err)
+		}
+	}
+}
+
+// peekedBody is a request body whose start was read to find the model.
+// Reading it returns that start again followed by the rest of the body, so
+// the body streams on to upstream without being held in memory.
+type peekedBody struct {
+	io.Reader
+	body  io.ReadCloser
+	model string
+}
+
+func (b *peekedBody) Close() error { return b.body.Close() }
+
+// modelFromBody peeks at the request body for the model. The result is kept
+// with the body, so later calls don't read it again.
+func modelFromBody(req *http.Request) string {
+	if req.Body == nil || req.Body == http.NoBody {
+		return ""
+	}
+	if b, ok := req.Body.(*peekedBody); ok {
+		return b.model
+	}
+
+	var prefix bytes.Buffer
+	var model string
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		model = peekMultipartModel(io.TeeReader(io.LimitReader(req.Body, ModelPeekLimit), &prefix), params["boundary"])
+	} else {
+		model = peekJSONModel(req.Body, &prefix)
+	}
+	req.Body = &peekedBody{Reader: io.MultiReader(&prefix, req.Body), body: req.Body, model: model}
+	return model
+}
+
+// peekBody returns up to n bytes of the start of the body and puts them back
+// in front of the rest like modelFromBody, so the body still streams.
+func peekBody(req *http.Request, n int64) []byte {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	model := modelFromBody(req)
+	orig := req.Body.(*peekedBody)
+	var prefix bytes.Buffer
+	io.CopyN(&prefix, orig.Reader, n) // a read error is seen again by the proxy
+	req.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(prefix.Bytes()), orig.Reader), body: orig.body, model: model}
+	return prefix.Bytes()
+}
+
+// readBody reads the whole body of a request that has to be rewritten and
+// puts it back. If reading fails, e.g. over the body limit, what was read is
+// put back in front of the failing body so sending it fails the same way.
+func readBody(req *http.Request) ([]byte, error) {
+	orig := req.Body
+	body, err := io.ReadAll(orig)
+	if err != nil {
+		failed := &peekedBody{Reader: io.MultiReader(bytes.NewReader(body), orig), body: orig}
+		if b, ok := orig.(*peekedBody); ok {
+			failed.model = b.model
+		}
+		req.Body = failed
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// peekJSONModel reads the body into prefix until its top-level model field
+// is complete. The prefix is parsed at doubling sizes so large bodies are
+// scanned a bounded number of times.
+func peekJSONModel(body io.Reader, prefix *bytes.Buffer) string {
+	for size := int64(64 << 10); ; size *= 2 {
+		size = min(size, ModelPeekLimit)
+		n, err := io.CopyN(prefix, body, size-int64(prefix.Len()))
+		complete := err != nil // EOF, or a read error the proxy will see again
+		data := prefix.Bytes()
+		if r := gjson.GetBytes(data, "model"); r.Type == gjson.String && (complete || r.Index > 0 && r.Index+len(r.Raw) < len(data)) {
+			return r.String()
+		}
+		if complete || n == 0 || size >= ModelPeekLimit {
+			return ""
+		}
+	}
+}
+
+// peekMultipartModel reads form fields up to the model field. It stops at
+// the first file, which is left to stream through.
+func peekMultipartModel(r io.Reader, boundary string) string {
+	if boundary == "" {
+		return ""
+	}
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil || part.FileName() != "" {
+			return ""
+		}
+		if part.FormName() == "model" {
+			v, _ := io.ReadAll(io.LimitReader(part, 256))
+			return strings.TrimSpace(string(v))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package azure
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/bodylimit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+)
+
+// Response headers telling clients where their request went.
+const (
+	BackendHeader           = "x-proxy-backend"
+	DeploymentHeader        = "x-proxy-deployment"
+	UpstreamRequestIDHeader = "x-proxy-upstream-request-id"
+	RegionHeader            = "x-proxy-region"
+)
+
+// SetDiagnosticHeaders adds the backend and deployment of a request, and
+// the upstream request id and region once known, to h.
+func SetDiagnosticHeaders(h http.Header, info *RequestInfo) {
+	for name, v := range map[string]string{
+		BackendHeader:           info.Backend,
+		DeploymentHeader:        info.Deployment,
+		UpstreamRequestIDHeader: info.UpstreamRequestID,
+		RegionHeader:            info.Region,
+	} {
+		if v != "" {
+			h.Set(name, v)
+		}
+	}
+}
+
+// DelDiagnosticHeaders removes the headers again. The reverse proxy adds the
+// upstream response's headers to those already set, so they have to be
+// cleared before proxying to not show up twice.
+func DelDiagnosticHeaders(h http.Header) {
+	for _, name := range []string{BackendHeader, DeploymentHeader, UpstreamRequestIDHeader, RegionHeader} {
+		h.Del(name)
+	}
+}
+
+// setUpstreamHeaders picks the upstream request id and region out of a
+// response and adds the diagnostic headers to it.
+func setUpstreamHeaders(res *http.Response) {
+	info := RequestInfoFromContext(res.Request.Context())
+	for _, name := range []string{"apim-request-id", "x-ms-request-id", apierror.RequestIDHeader} {
+		if v := res.Header.Get(name); v != "" {
+			info.UpstreamRequestID = v
+			break
+		}
+	}
+	info.Region = res.Header.Get("x-ms-region")
+	// The client gets the proxy's request id, upstream's own is passed on
+	// in x-proxy-upstream-request-id.
+	res.Header.Del(apierror.RequestIDHeader)
+
+	SetDiagnosticHeaders(res.Header, info)
+	if info.UpstreamRequestID != "" {
+		logging.AddAttrs(res.Request.Context(), "upstream_request_id", info.UpstreamRequestID)
+	}
+}
+
+// errorHandler answers requests that never got an upstream response.
+func errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	SetDiagnosticHeaders(rw.Header(), RequestInfoFromContext(req.Context()))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		bodylimit.Reject(rw, tooLarge.Limit)
+		return
+	}
+	// Cancelled requests, the client went away or another hedged attempt
+	// answered first, aren't upstream's fault.
+	if req.Context().Err() == nil {
+		logging.FromContext(req.Context()).Error("upstream request failed", "error", err)
+		RecordError(req, http.StatusBadGateway, "bad_gateway", err.Error())
+		observeLatency(RequestInfoFromContext(req.Context()), http.StatusBadGateway)
+	}
+	apierror.Write(rw, http.StatusBadGateway, "proxy_error", "bad_gateway", "Failed to reach the upstream backend")
+}
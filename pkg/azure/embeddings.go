@@ -0,0 +1,460 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// EmbeddingsMaxInputs is the most inputs sent upstream in one embeddings
+	// call. Larger requests are split.
+	EmbeddingsMaxInputs = 2048
+	// EmbeddingsMaxTokens bounds the tokens of the inputs sent in one call.
+	EmbeddingsMaxTokens = 300000
+	// EmbeddingsConcurrency is how many calls of a split request run at once.
+	EmbeddingsConcurrency = 4
+	// EmbeddingsBatchWindow is how long small embeddings requests wait for
+	// others to share an upstream call with. Micro-batching is off when 0.
+	EmbeddingsBatchWindow time.Duration
+)
+
+// maxBatchedBody is the largest request that is micro-batched, bigger ones
+// gain nothing from sharing a call.
+const maxBatchedBody = 64 << 10
+
+func init() {
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_EMBEDDINGS_MAX_INPUTS")); err == nil && v > 0 {
+		EmbeddingsMaxInputs = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_EMBEDDINGS_MAX_TOKENS")); err == nil && v > 0 {
+		EmbeddingsMaxTokens = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_EMBEDDINGS_CONCURRENCY")); err == nil && v > 0 {
+		EmbeddingsConcurrency = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_EMBEDDINGS_BATCH_WINDOW")); err == nil && v > 0 {
+		EmbeddingsBatchWindow = v
+		log.Printf("Micro-batching embeddings requests within %s", v)
+	}
+}
+
+// ResponseBuffer collects a response the proxy makes for itself.
+type ResponseBuffer struct {
+	Status int
+	Body   bytes.Buffer
+	header http.Header
+}
+
+func NewResponseBuffer() *ResponseBuffer {
+	return &ResponseBuffer{header: http.Header{}}
+}
+
+func (r *ResponseBuffer) Header() http.Header { return r.header }
+
+func (r *ResponseBuffer) WriteHeader(status int) { r.Status = status }
+
+func (r *ResponseBuffer) Write(p []byte) (int, error) {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	return r.Body.Write(p)
+}
+
+// ServeEmbeddings splits an embeddings request that is too large for one
+// upstream call into several calls through proxy and merges their results.
+// Small requests are micro-batched with others when EmbeddingsBatchWindow is
+// set. It returns false, without writing anything, for requests that are to
+// be proxied as they are.
+func ServeEmbeddings(proxy http.Handler, w http.ResponseWriter, req *http.Request) bool {
+	body, err := readBody(req)
+	if err != nil {
+		return false
+	}
+	inputs := embeddingInputs(gjson.GetBytes(body, "input"))
+	if len(inputs) == 0 {
+		return false
+	}
+	info := RequestInfoFromContext(req.Context())
+
+	// A token is at least a byte, so only bodies this large need counting.
+	var tokens []int
+	if len(body) > EmbeddingsMaxTokens {
+		tokens = inputTokens(info.Model, inputs)
+	}
+	batches := embeddingBatches(inputs, tokens)
+	if len(batches) > 1 {
+		serveSplitEmbeddings(proxy, w, req, body, batches)
+		return true
+	}
+	if EmbeddingsBatchWindow > 0 && len(body) <= maxBatchedBody {
+		return serveBatchedEmbeddings(proxy, w, req, body, inputs)
+	}
+	return false
+}
+
+// embeddingInputs returns the inputs of an embeddings request. A string or
+// a list of token ids is a single input.
+func embeddingInputs(input gjson.Result) []string {
+	if !input.IsArray() {
+		if input.Type == gjson.String {
+			return []string{input.Raw}
+		}
+		return nil
+	}
+	items := input.Array()
+	if len(items) > 0 && items[0].Type == gjson.Number {
+		return []string{input.Raw}
+	}
+	inputs := make([]string, len(items))
+	for i, item := range items {
+		inputs[i] = item.Raw
+	}
+	return inputs
+}
+
+// inputTokens counts the tokens of each input with the model's tokenizer.
+func inputTokens(model string, inputs []string) []int {
+	enc := encodingFor(model)
+	tokens := make([]int, len(inputs))
+	for i, raw := range inputs {
+		input := gjson.Parse(raw)
+		switch {
+		case input.Type != gjson.String:
+			tokens[i] = len(input.Array())
+		case enc != nil:
+			tokens[i] = len(enc.EncodeOrdinary(input.Str))
+		default:
+			tokens[i] = len(input.Str)
+		}
+	}
+	return tokens
+}
+
+// embeddingBatches groups inputs, in order, into batches within the limits
+// of one call. An input over the token limit is sent on its own for
+// upstream to reject.
+func embeddingBatches(inputs []string, tokens []int) [][]string {
+	var batches [][]string
+	start, sum := 0, 0
+	for i := range inputs {
+		n := 0
+		if tokens != nil {
+			n = tokens[i]
+		}
+		if i > start && (i-start >= EmbeddingsMaxInputs || sum+n > EmbeddingsMaxTokens) {
+			batches = append(batches, inputs[start:i])
+			start, sum = i, 0
+		}
+		sum += n
+	}
+	return append(batches, inputs[start:])
+}
+
+// errEmbeddingsAborted is returned for a call whose response couldn't be
+// copied, because ctx was cancelled or upstream broke off.
+var errEmbeddingsAborted = errors.New("embeddings call aborted")
+
+// callEmbeddings makes one upstream embeddings call for inputs, with the
+// rest of the request as in body.
+func callEmbeddings(proxy http.Handler, ctx context.Context, req *http.Request, body []byte, inputs []string) (*ResponseBuffer, *RequestInfo, error) {
+	body, err := sjson.SetRawBytes(body, "input", []byte("["+strings.Join(inputs, ",")+"]"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, info := WithRequestInfo(ctx, RequestInfoFromContext(req.Context()).Route)
+	sub := req.Clone(ctx)
+	sub.Body = io.NopCloser(bytes.NewReader(body))
+	sub.ContentLength = int64(len(body))
+	res := NewResponseBuffer()
+	aborted := serveAbortable(proxy, res, sub)
+	metrics.EmbeddingsCalls.WithLabelValues(info.MetricLabels()).Inc()
+	if aborted {
+		return nil, info, errEmbeddingsAborted
+	}
+	return res, info, nil
+}
+
+// serveAbortable proxies a request outside of the handler's goroutine.
+// ReverseProxy gives up on a response it can't copy, e.g. once ctx was
+// cancelled, by panicking with http.ErrAbortHandler, which only the server
+// recovers.
+func serveAbortable(proxy http.Handler, w http.ResponseWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			aborted = true
+		}
+	}()
+	proxy.ServeHTTP(w, req)
+	return false
+}
+
+// serveSplitEmbeddings sends the batches concurrently and writes the merged
+// result, or the first failed call's response.
+func serveSplitEmbeddings(proxy http.Handler, w http.ResponseWriter, req *http.Request, body []byte, batches [][]string) {
+	ctx, cancel := context.WithCancel(logging.Fork(req.Context()))
+	defer cancel()
+	info := RequestInfoFromContext(req.Context())
+	logging.AddAttrs(req.Context(), "embedding_calls", len(batches))
+
+	results := make([]*ResponseBuffer, len(batches))
+	infos := make([]*RequestInfo, len(batches))
+	sem := make(chan struct{}, EmbeddingsConcurrency)
+	var failed atomic.Int32 // index+1 of the first failed call
+	var aborted atomic.Bool
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+			res, sub, err := callEmbeddings(proxy, ctx, req, body, batch)
+			results[i], infos[i] = res, sub
+			if err != nil {
+				aborted.Store(true)
+				cancel()
+			} else if res.Status != http.StatusOK && failed.CompareAndSwap(0, int32(i+1)) {
+				// No point in finishing the others.
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, sub := range infos {
+		if sub == nil {
+			continue
+		}
+		info.Usage.PromptTokens += sub.Usage.PromptTokens
+		info.Usage.TotalTokens += sub.Usage.TotalTokens
+		info.Retries += sub.Retries
+		if info.UpstreamRequestID == "" {
+			info.UpstreamRequestID, info.Region = sub.UpstreamRequestID, sub.Region
+		}
+	}
+	logging.AddAttrs(req.Context(), "model", info.Model, "deployment", info.Deployment, "backend", info.Backend, "upstream_request_id", info.UpstreamRequestID)
+	if i := failed.Load(); i > 0 {
+		writeBuffered(w, results[i-1], results[i-1].Body.Bytes())
+		return
+	}
+	if req.Context().Err() != nil {
+		// The client went away.
+		return
+	}
+	if aborted.Load() {
+		// Upstream broke off a response, the others were cancelled.
+		apierror.Write(w, http.StatusBadGateway, "proxy_error", "bad_gateway", "Failed to reach the upstream backend")
+		return
+	}
+
+	var data bytes.Buffer
+	data.WriteByte('[')
+	offset := 0
+	for i, res := range results {
+		items := gjson.GetBytes(res.Body.Bytes(), "data").Array()
+		for j, item := range items {
+			raw, _ := sjson.SetBytes([]byte(item.Raw), "index", offset+int(item.Get("index").Int()))
+			if offset+j > 0 {
+				data.WriteByte(',')
+			}
+			data.Write(raw)
+		}
+		offset += len(batches[i])
+	}
+	data.WriteByte(']')
+
+	merged, _ := sjson.SetRawBytes(results[0].Body.Bytes(), "data", data.Bytes())
+	merged, _ = sjson.SetBytes(merged, "usage.prompt_tokens", info.Usage.PromptTokens)
+	merged, _ = sjson.SetBytes(merged, "usage.total_tokens", info.Usage.TotalTokens)
+	writeBuffered(w, results[0], merged)
+}
+
+// writeBuffered writes a buffered upstream response with body in place of
+// its own.
+func writeBuffered(w http.ResponseWriter, res *ResponseBuffer, body []byte) {
+	for name, v := range res.Header() {
+		if name != "Content-Length" {
+			w.Header()[name] = v
+		}
+	}
+	w.WriteHeader(res.Status)
+	w.Write(body)
+}
+
+// embeddingBatch is an upstream call shared by small embeddings requests
+// with the same parameters.
+type embeddingBatch struct {
+	key     string
+	req     *http.Request // of the first request, the call is made like it
+	body    []byte
+	inputs  []string
+	size    int
+	members []*batchMember
+	sent    bool
+	done    chan struct{}
+	res     *ResponseBuffer
+	info    *RequestInfo
+}
+
+type batchMember struct {
+	offset, count, tokens int
+}
+
+var (
+	batchMu sync.Mutex
+	batches = map[string]*embeddingBatch{}
+)
+
+// serveBatchedEmbeddings adds the request to the open batch of its caller
+// and parameters and writes its share of the result. It returns false when
+// the batch failed, the request is then proxied on its own.
+func serveBatchedEmbeddings(proxy http.Handler, w http.ResponseWriter, req *http.Request, body []byte, inputs []string) bool {
+	info := RequestInfoFromContext(req.Context())
+	params, err := sjson.DeleteBytes(body, "input")
+	if err != nil {
+		return false
+	}
+	id := auth.FromContext(req.Context())
+	scope := cache.KeyScope(id, req.Header.Get("api-key")+req.Header.Get("Authorization"))
+	key, err := cache.Key(scope, info.Backend+"/"+info.Deployment, info.Route, params)
+	if err != nil {
+		return false
+	}
+	member := &batchMember{count: len(inputs), tokens: sum(inputTokens(info.Model, inputs))}
+
+	batchMu.Lock()
+	b := batches[key]
+	if b != nil && (len(b.inputs)+len(inputs) > EmbeddingsMaxInputs || b.size+len(body) > EmbeddingsMaxTokens) {
+		b.send(proxy)
+		b = nil
+	}
+	if b == nil {
+		b = &embeddingBatch{key: key, req: req, body: body, done: make(chan struct{})}
+		batches[key] = b
+		time.AfterFunc(EmbeddingsBatchWindow, func() {
+			batchMu.Lock()
+			defer batchMu.Unlock()
+			b.send(proxy)
+		})
+	}
+	member.offset = len(b.inputs)
+	b.inputs = append(b.inputs, inputs...)
+	b.size += len(body)
+	b.members = append(b.members, member)
+	if len(b.inputs) >= EmbeddingsMaxInputs {
+		b.send(proxy)
+	}
+	batchMu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-req.Context().Done():
+		return true
+	}
+	if b.res == nil || b.res.Status != http.StatusOK {
+		return false
+	}
+
+	// Upstream reports the usage of the whole call, every request is
+	// charged its share by its own token count. Shares are cut from the
+	// running sum so they add up to the total.
+	total := int(gjson.GetBytes(b.res.Body.Bytes(), "usage.prompt_tokens").Int())
+	all, before := 0, 0
+	for _, m := range b.members {
+		if m.offset < member.offset {
+			before += m.tokens
+		}
+		all += m.tokens
+	}
+	tokens := member.tokens
+	if all > 0 {
+		tokens = total*(before+member.tokens)/all - total*before/all
+	}
+	info.Usage = TokenUsage{PromptTokens: tokens, TotalTokens: tokens}
+	info.UpstreamRequestID, info.Region = b.info.UpstreamRequestID, b.info.Region
+	if id != nil {
+		auth.Limits.RecordTokens(id, tokens)
+	}
+	logging.AddAttrs(req.Context(), "model", info.Model, "deployment", info.Deployment, "backend", info.Backend,
+		"upstream_request_id", info.UpstreamRequestID, "embedding_batch", len(b.members))
+
+	var data bytes.Buffer
+	data.WriteByte('[')
+	for _, item := range gjson.GetBytes(b.res.Body.Bytes(), "data").Array() {
+		index := int(item.Get("index").Int())
+		if index < member.offset || index >= member.offset+member.count {
+			continue
+		}
+		raw, _ := sjson.SetBytes([]byte(item.Raw), "index", index-member.offset)
+		if data.Len() > 1 {
+			data.WriteByte(',')
+		}
+		data.Write(raw)
+	}
+	data.WriteByte(']')
+	out, _ := sjson.SetRawBytes(b.res.Body.Bytes(), "data", data.Bytes())
+	out, _ = sjson.SetBytes(out, "usage.prompt_tokens", tokens)
+	out, _ = sjson.SetBytes(out, "usage.total_tokens", tokens)
+	writeBuffered(w, b.res, out)
+	return true
+}
+
+// send closes the batch and makes its call. batchMu must be held.
+func (b *embeddingBatch) send(proxy http.Handler) {
+	if b.sent {
+		return
+	}
+	b.sent = true
+	if batches[b.key] == b {
+		delete(batches, b.key)
+	}
+	go func() {
+		defer close(b.done)
+		// Not tied to the first request, which may go away while the others
+		// still wait. Tokens are charged to each request after the call.
+		ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(b.req.Context()))
+		// The identity decides whose keys sign the call: without it a
+		// virtual key or token would be forwarded upstream as an Azure key.
+		// Batches are per caller, so it is the same for every member.
+		if id := auth.FromContext(b.req.Context()); id != nil {
+			ctx = auth.WithIdentity(ctx, id)
+		}
+		res, info, err := callEmbeddings(proxy, ctx, b.req, b.body, b.inputs)
+		if err == nil {
+			b.res, b.info = res, info
+		}
+	}()
+}
+
+func sum(values []int) int {
+	n := 0
+	for _, v := range values {
+		n += v
+	}
+	return n
+}
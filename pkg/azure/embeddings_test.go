@@ -0,0 +1,83 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/tidwall/gjson"
+)
+
+// TestBatchedEmbeddingsUseProxyKeys checks that a micro-batched call of
+// callers authenticated by the proxy is signed with the proxy's Azure key,
+// never with the caller's own credential.
+func TestBatchedEmbeddingsUseProxyKeys(t *testing.T) {
+	type call struct {
+		apiKey, authorization string
+		inputs                int
+	}
+	var (
+		mu    sync.Mutex
+		calls []call
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		inputs := gjson.GetBytes(body, "input").Array()
+		mu.Lock()
+		calls = append(calls, call{r.Header.Get("api-key"), r.Header.Get("Authorization"), len(inputs)})
+		mu.Unlock()
+		var data []string
+		for i := range inputs {
+			data = append(data, fmt.Sprintf(`{"object":"embedding","index":%d,"embedding":[0.5]}`, i))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"object":"list","data":[%s],"usage":{"prompt_tokens":2,"total_tokens":2}}`, strings.Join(data, ","))
+	}))
+	defer srv.Close()
+
+	defer func(endpoint string, keys *KeyPool, window time.Duration) {
+		AzureOpenAIEndpoint, AzureKeys, EmbeddingsBatchWindow = endpoint, keys, window
+	}(AzureOpenAIEndpoint, AzureKeys, EmbeddingsBatchWindow)
+	AzureOpenAIEndpoint = srv.URL
+	AzureKeys = NewKeyPool("azure", []string{"azure-key"}, nil)
+	EmbeddingsBatchWindow = 50 * time.Millisecond
+
+	proxy := NewOpenAIReverseProxy()
+	id := &auth.Identity{ID: "key:test"}
+	var wg sync.WaitGroup
+	for _, input := range []string{"hello", "world"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, info := WithRequestInfo(auth.WithIdentity(context.Background(), id), "/v1/embeddings")
+			info.Model, info.Backend, info.Deployment = "text-embedding-3-small", "azure", "text-embedding-3-small-1"
+			body, _ := json.Marshal(map[string]string{"model": info.Model, "input": input})
+			req := httptest.NewRequestWithContext(ctx, "POST", "/v1/embeddings", strings.NewReader(string(body)))
+			req.Header.Set("Authorization", "Bearer sk-virtual-key")
+			w := httptest.NewRecorder()
+			if !ServeEmbeddings(proxy, w, req) {
+				t.Errorf("%s: not batched", input)
+				return
+			}
+			if w.Code != http.StatusOK || len(gjson.Get(w.Body.String(), "data").Array()) != 1 {
+				t.Errorf("%s: status %d, body %s", input, w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(calls) != 1 || calls[0].inputs != 2 {
+		t.Fatalf("upstream calls = %+v, want one with both inputs", calls)
+	}
+	if c := calls[0]; c.apiKey != "azure-key" || c.authorization != "" {
+		t.Fatalf("upstream got api-key %q, Authorization %q, want the proxy's key only", c.apiKey, c.authorization)
+	}
+}
@@ -0,0 +1,145 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/health"
+	"github.com/gyarbij/azure-oai-proxy/pkg/upstream"
+)
+
+// HealthChecks returns the readiness checks for the configured endpoint and
+// regions, the given deployments and serverless deployments. Only deployments
+// the operator configured are probed, the built-in model mappings name
+// deployments most resources don't have. None of the probes run inference,
+// so they cost no tokens.
+func HealthChecks(deployments []string) []health.Check {
+	checks := []health.Check{{Name: "config", Run: checkConfig}}
+
+	if len(AzureKeys.Status()) > 0 {
+		checks = append(checks, health.Check{Name: "credentials/azure", Run: credentialsProbe(AzureOpenAIEndpoint, AzureKeys)})
+
+		seen := map[string]bool{}
+		for _, d := range deployments {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			checks = append(checks, health.Check{Name: "deployment/" + d, Run: deploymentProbe(d)})
+		}
+	}
+
+	for _, r := range Regions {
+		checks = append(checks, health.Check{Name: "credentials/" + r.Name, Run: credentialsProbe(r.Endpoint, r.Keys)})
+	}
+	for name, info := range ServerlessDeploymentInfo {
+		checks = append(checks, health.Check{Name: "backend/" + name, Run: serverlessProbe(info)})
+	}
+	return checks
+}
+
+func checkConfig(ctx context.Context) error {
+	if AzureOpenAIEndpoint == "" {
+		return errors.New("AZURE_OPENAI_ENDPOINT is not set")
+	}
+	u, err := url.Parse(AzureOpenAIEndpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("AZURE_OPENAI_ENDPOINT %q is not a valid URL", AzureOpenAIEndpoint)
+	}
+	for name, info := range ServerlessDeploymentInfo {
+		if info.Name == "" || info.Region == "" {
+			return fmt.Errorf("serverless deployment %s has no name or region", name)
+		}
+		if len(info.Keys.Status()) == 0 {
+			return fmt.Errorf("serverless deployment %s has no key", name)
+		}
+	}
+	return nil
+}
+
+// credentialsProbe lists models with the pool's keys, one working key is
+// enough.
+func credentialsProbe(endpoint string, pool *KeyPool) func(context.Context) error {
+	return func(ctx context.Context) error {
+		var lastErr error
+		for range pool.Status() {
+			req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/openai/models?api-version=%s", strings.TrimSuffix(endpoint, "/"), AzureOpenAIModelsAPIVersion), nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("api-key", pool.Next())
+			if lastErr = classifyProbe(probe(req)); lastErr == nil {
+				return nil
+			}
+		}
+		return lastErr
+	}
+}
+
+// deploymentProbe calls chat completions on the deployment with an empty
+// message list. Azure rejects it with 400 before any inference when the
+// deployment exists (also for non-chat models) and with 404 when it doesn't.
+func deploymentProbe(deployment string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		u := fmt.Sprintf("%s%s?api-version=%s", strings.TrimSuffix(AzureOpenAIEndpoint, "/"), path.Join("/openai/deployments", deployment, "chat/completions"), AzureOpenAIAPIVersion)
+		req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(`{"messages":[]}`))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("api-key", AzureKeys.Next())
+		status, err := probe(req)
+		if err == nil && status == http.StatusBadRequest {
+			return nil
+		}
+		return classifyProbe(status, err)
+	}
+}
+
+func serverlessProbe(info ServerlessDeployment) func(context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://"+info.Host()+"/info", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+info.Keys.Next())
+		status, err := probe(req)
+		if err == nil && status == http.StatusNotFound {
+			// Reachable, just no info route on this model.
+			return nil
+		}
+		return classifyProbe(status, err)
+	}
+}
+
+func probe(req *http.Request) (int, error) {
+	res, err := upstream.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	return res.StatusCode, nil
+}
+
+// classifyProbe turns a probe outcome into a check error. Rejected keys and
+// missing deployments are misconfiguration and fail the check, outages and
+// throttling only degrade it.
+func classifyProbe(status int, err error) error {
+	switch {
+	case err != nil:
+		return health.MarkDegraded(err)
+	case status < 300:
+		return nil
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusNotFound:
+		return fmt.Errorf("upstream returned %d", status)
+	default:
+		return health.MarkDegraded(fmt.Errorf("upstream returned %d", status))
+	}
+}
@@ -0,0 +1,257 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	// HedgeDelay is how long a chat completion or completion may take to
+	// send its first byte, its first chunk when streamed, before it is sent
+	// to a second backend too. Hedging is off when 0.
+	HedgeDelay time.Duration
+	// HedgeBudget caps the extra requests hedging makes, as a fraction of
+	// the requests that could be hedged.
+	HedgeBudget = 0.05
+)
+
+// hedgeBurst is how many unused hedges the budget saves up.
+const hedgeBurst = 10
+
+func init() {
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_HEDGE_DELAY")); err == nil && v > 0 {
+		HedgeDelay = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("AZURE_OPENAI_PROXY_HEDGE_BUDGET"), 64); err == nil && v >= 0 && v <= 1 {
+		HedgeBudget = v
+	}
+}
+
+// hedgeTokens is the budget: every request that could be hedged earns
+// HedgeBudget, a hedge costs one.
+var hedgeTokens struct {
+	sync.Mutex
+	n float64
+}
+
+func earnHedge() {
+	hedgeTokens.Lock()
+	defer hedgeTokens.Unlock()
+	hedgeTokens.n = min(hedgeTokens.n+HedgeBudget, hedgeBurst)
+}
+
+func spendHedge() bool {
+	hedgeTokens.Lock()
+	defer hedgeTokens.Unlock()
+	if hedgeTokens.n < 1 {
+		return false
+	}
+	hedgeTokens.n--
+	return true
+}
+
+// errHedgeLost stops copying the response of an attempt that answered
+// second.
+var errHedgeLost = errors.New("another backend answered first")
+
+// ServeHedged proxies a chat completion or completion and, if it hasn't
+// started to answer after HedgeDelay, sends it to another backend of the
+// model too. Whichever answers first is relayed, the other is cancelled. It
+// returns false, without writing anything, for requests that aren't hedged.
+func ServeHedged(proxy http.Handler, w http.ResponseWriter, req *http.Request) bool {
+	info := RequestInfoFromContext(req.Context())
+	if HedgeDelay == 0 || info.Route != "/v1/chat/completions" && info.Route != "/v1/completions" {
+		return false
+	}
+	// The handler picked the first backend, the hedge goes to the best of
+	// the others.
+	var backends []string
+	for _, b := range Backends(req, info.Model) {
+		if b != info.Backend {
+			backends = append(backends, b)
+		}
+	}
+	if len(backends) == 0 {
+		return false
+	}
+	body, err := readBody(req)
+	if err != nil || len(body) > maxRetryBody {
+		return false
+	}
+	earnHedge()
+	model, _ := info.MetricLabels()
+
+	r := &hedgeRace{w: w, proxy: proxy, req: req, body: body, finished: make(chan *hedgeAttempt, 2)}
+	// Attempts log their own fields, the winner's are added below.
+	ctx := logging.Fork(req.Context())
+	r.start(ctx, info.Backend, false)
+	running := 1
+	timer := time.NewTimer(HedgeDelay)
+	defer timer.Stop()
+	var last *hedgeAttempt
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if r.decided() {
+				continue
+			}
+			if !spendHedge() {
+				metrics.HedgedRequests.WithLabelValues(model, "over_budget").Inc()
+				continue
+			}
+			if r.start(ctx, backends[0], true) {
+				running++
+			}
+		case last = <-r.finished:
+			running--
+		}
+	}
+
+	a := r.finish(last)
+	start := info.Start
+	*info = *a.info
+	info.Start = start
+	if r.hedged {
+		result := "primary_won"
+		if a.hedge {
+			result = "hedge_won"
+		}
+		metrics.HedgedRequests.WithLabelValues(model, result).Inc()
+	}
+	logging.AddAttrs(req.Context(), "model", info.Model, "deployment", info.Deployment, "backend", info.Backend, "upstream_request_id", info.UpstreamRequestID, "hedged", r.hedged)
+	if a.aborted {
+		// Like the reverse proxy when the client goes away mid-response.
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+// hedgeRace relays the first attempt to answer.
+type hedgeRace struct {
+	w        http.ResponseWriter
+	proxy    http.Handler
+	req      *http.Request
+	body     []byte
+	finished chan *hedgeAttempt
+
+	mu       sync.Mutex
+	attempts []*hedgeAttempt
+	winner   *hedgeAttempt
+	hedged   bool
+}
+
+// hedgeAttempt is the request sent to one backend. Its response goes to the
+// client once it wins, errors are buffered in case no backend does better.
+type hedgeAttempt struct {
+	*ResponseBuffer
+	race    *hedgeRace
+	info    *RequestInfo
+	hedge   bool
+	cancel  context.CancelFunc
+	won     bool
+	aborted bool
+}
+
+// start sends the request to backend unless an attempt has already won.
+func (r *hedgeRace) start(ctx context.Context, backend string, hedge bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner != nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	orig := RequestInfoFromContext(r.req.Context())
+	ctx, info := WithRequestInfo(ctx, orig.Route)
+	info.Backend, info.Capture = backend, orig.Capture
+	a := &hedgeAttempt{ResponseBuffer: NewResponseBuffer(), race: r, info: info, hedge: hedge, cancel: cancel}
+	r.attempts = append(r.attempts, a)
+	r.hedged = r.hedged || hedge
+
+	sub := r.req.Clone(ctx)
+	sub.Body = io.NopCloser(bytes.NewReader(r.body))
+	sub.ContentLength = int64(len(r.body))
+	go func() {
+		defer cancel()
+		if hedge {
+			// The request itself is counted by the handler.
+			defer BeginRequest(backend)()
+		}
+		a.aborted = serveAbortable(r.proxy, a, sub)
+		r.finished <- a
+	}()
+	return true
+}
+
+func (r *hedgeRace) decided() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.winner != nil
+}
+
+// claim makes a the winner, unless another attempt was first, and sends its
+// status and headers to the client.
+func (r *hedgeRace) claim(a *hedgeAttempt) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner != nil {
+		return r.winner == a
+	}
+	r.winner, a.won = a, true
+	for _, other := range r.attempts {
+		if other != a {
+			other.cancel()
+		}
+	}
+	for name, v := range a.Header() {
+		r.w.Header()[name] = v
+	}
+	r.w.WriteHeader(a.Status)
+	return true
+}
+
+// finish returns the winner. When every attempt failed the last one's
+// response is relayed.
+func (r *hedgeRace) finish(last *hedgeAttempt) *hedgeAttempt {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.winner == nil {
+		r.winner = last
+		if last.Status == 0 {
+			last.Status = http.StatusBadGateway
+		}
+		writeBuffered(r.w, last.ResponseBuffer, last.Body.Bytes())
+	}
+	return r.winner
+}
+
+func (a *hedgeAttempt) Write(p []byte) (int, error) {
+	if a.Status == 0 {
+		a.Status = http.StatusOK
+	}
+	if !a.won {
+		if a.Status == http.StatusTooManyRequests || a.Status >= 500 {
+			// Throttled or failed, another backend may still do better.
+			return a.Body.Write(p)
+		}
+		if !a.race.claim(a) {
+			return 0, errHedgeLost
+		}
+	}
+	return a.race.w.Write(p)
+}
+
+func (a *hedgeAttempt) Flush() {
+	if a.won {
+		http.NewResponseController(a.race.w).Flush()
+	}
+}
@@ -0,0 +1,278 @@
+package azure
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// KeysFile is polled for key changes so keys can be rotated without a restart.
+	KeysFile = ""
+	// KeyRevalidateInterval is how often evicted keys are checked again.
+	KeyRevalidateInterval = time.Minute
+)
+
+// KeyPool holds the upstream keys of one backend. Requests are spread across
+// healthy keys round-robin, keys that are rejected with 401/403 are taken out
+// of rotation until a background probe shows they work again.
+type KeyPool struct {
+	name     string
+	validate func(ctx context.Context, key string) error
+
+	mu   sync.Mutex
+	keys []*poolKey
+	next int
+}
+
+type poolKey struct {
+	value     string
+	healthy   bool
+	evictedAt time.Time
+}
+
+// KeyStatus describes a key without revealing it.
+type KeyStatus struct {
+	Key       string    `json:"key"`
+	Healthy   bool      `json:"healthy"`
+	EvictedAt time.Time `json:"evicted_at,omitempty"`
+}
+
+func NewKeyPool(name string, keys []string, validate func(ctx context.Context, key string) error) *KeyPool {
+	p := &KeyPool{name: name, validate: validate}
+	p.SetKeys(keys)
+	return p
+}
+
+// Next returns the next healthy key. When every key has been evicted the one
+// evicted longest ago is returned, failing requests beat refusing them all.
+func (p *KeyPool) Next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.keys) == 0 {
+		return ""
+	}
+	for range p.keys {
+		k := p.keys[p.next%len(p.keys)]
+		p.next++
+		if k.healthy {
+			return k.value
+		}
+	}
+
+	oldest := p.keys[0]
+	for _, k := range p.keys[1:] {
+		if k.evictedAt.Before(oldest.evictedAt) {
+			oldest = k
+		}
+	}
+	return oldest.value
+}
+
+// Contains reports whether key belongs to the pool.
+func (p *KeyPool) Contains(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.find(key) != nil
+}
+
+// Healthy returns the number of keys currently in rotation.
+func (p *KeyPool) Healthy() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, k := range p.keys {
+		if k.healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// Evict takes key out of rotation.
+func (p *KeyPool) Evict(key string, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k := p.find(key); k != nil && k.healthy {
+		k.healthy = false
+		k.evictedAt = time.Now()
+		log.Printf("Evicted key %s from %s pool after status %d", maskKey(key), p.name, status)
+	}
+}
+
+// SetKeys replaces the pool's keys. Keys that were already present keep
+// their health state.
+func (p *KeyPool) SetKeys(values []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]*poolKey, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if k := p.find(v); k != nil {
+			keys = append(keys, k)
+		} else {
+			keys = append(keys, &poolKey{value: v, healthy: true})
+		}
+	}
+	p.keys = keys
+}
+
+// Status returns the state of every key, with the keys masked.
+func (p *KeyPool) Status() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := make([]KeyStatus, 0, len(p.keys))
+	for _, k := range p.keys {
+		status = append(status, KeyStatus{Key: maskKey(k.value), Healthy: k.healthy, EvictedAt: k.evictedAt})
+	}
+	return status
+}
+
+func (p *KeyPool) find(key string) *poolKey {
+	for _, k := range p.keys {
+		if k.value == key {
+			return k
+		}
+	}
+	return nil
+}
+
+// revalidate probes evicted keys and puts the ones that work back.
+func (p *KeyPool) revalidate(ctx context.Context) {
+	if p.validate == nil {
+		return
+	}
+
+	p.mu.Lock()
+	var evicted []string
+	for _, k := range p.keys {
+		if !k.healthy {
+			evicted = append(evicted, k.value)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, key := range evicted {
+		if err := p.validate(ctx, key); err != nil {
+			log.Printf("Key %s in %s pool is still failing: %v", maskKey(key), p.name, err)
+			continue
+		}
+		p.mu.Lock()
+		if k := p.find(key); k != nil {
+			k.healthy = true
+			k.evictedAt = time.Time{}
+		}
+		p.mu.Unlock()
+		log.Printf("Key %s restored to %s pool", maskKey(key), p.name)
+	}
+}
+
+// StartKeyRotation revalidates evicted keys and, when KeysFile is set,
+// reloads keys whenever the file changes.
+func StartKeyRotation(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(KeyRevalidateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, p := range keyPools() {
+					p.revalidate(ctx)
+				}
+			}
+		}
+	}()
+
+	if KeysFile != "" {
+		go watchKeysFile(ctx, KeysFile)
+	}
+}
+
+// watchKeysFile polls the keys file for changes. Each non-comment line has
+// the form "<backend>=<key>[,<key>...]" where backend is "azure" for the
+// Azure OpenAI endpoint or the name of a serverless deployment.
+func watchKeysFile(ctx context.Context, file string) {
+	var lastMod time.Time
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		if info, err := os.Stat(file); err != nil {
+			log.Printf("Error reading keys file: %v", err)
+		} else if !info.ModTime().Equal(lastMod) {
+			lastMod = info.ModTime()
+			loadKeysFile(file)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func loadKeysFile(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Printf("Error reading keys file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		pool := AzureKeys
+		if r, ok := region(name); ok {
+			pool = r.Keys
+		} else if name != "azure" {
+			info, ok := ServerlessDeploymentInfo[name]
+			if !ok {
+				log.Printf("Keys file references unknown backend %s", name)
+				continue
+			}
+			pool = info.Keys
+		}
+		keys := strings.Split(value, ",")
+		pool.SetKeys(keys)
+		log.Printf("Loaded %d keys for %s from keys file", len(keys), name)
+	}
+}
+
+func keyPools() []*KeyPool {
+	pools := []*KeyPool{AzureKeys}
+	for _, r := range Regions {
+		pools = append(pools, r.Keys)
+	}
+	for _, info := range ServerlessDeploymentInfo {
+		pools = append(pools, info.Keys)
+	}
+	return pools
+}
+
+// maskKey shortens a key to something safe to log.
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
@@ -0,0 +1,264 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/upstream"
+	"github.com/tidwall/gjson"
+)
+
+// ModelsRefreshInterval is how often the model list is refreshed from Azure.
+var ModelsRefreshInterval = 5 * time.Minute
+
+// deploymentsAPIVersion is the last data plane version that lists
+// deployments.
+const deploymentsAPIVersion = "2022-12-01"
+
+func init() {
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_MODELS_REFRESH")); err == nil && v > 0 {
+		ModelsRefreshInterval = v
+	}
+}
+
+// ModelEntry is a model clients can call, in the format of OpenAI's model
+// list with the capabilities Azure reports for it added. Capabilities are
+// left out when they aren't known.
+type ModelEntry struct {
+	ID           string        `json:"id"`
+	Object       string        `json:"object"`
+	Created      int64         `json:"created"`
+	OwnedBy      string        `json:"owned_by"`
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+}
+
+var (
+	modelsMu sync.RWMutex
+	models   []ModelEntry
+)
+
+// Models returns the models callers using the proxy's keys can call: the
+// deployments of the Azure resource, the aliases of the model mapper that
+// point at one of them and the serverless deployments.
+func Models() []ModelEntry {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	if models == nil {
+		return listModels(nil, nil)
+	}
+	return models
+}
+
+// ModelsFor returns the models the caller of req can call. Passthrough
+// callers bring their own Azure key, the deployments are listed with it
+// like their requests are made with it.
+func ModelsFor(req *http.Request) ([]ModelEntry, error) {
+	if usesProxyKeys(req) {
+		return Models(), nil
+	}
+	key := clientKey(req)
+	deployments, err := fetchDeployments(req.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := fetchModelCatalog(req.Context(), key)
+	if err != nil {
+		logging.FromContext(req.Context()).Warn("error listing models", "error", err)
+	}
+	return listModels(deployments, catalog), nil
+}
+
+// FindModel returns the model with id from list, ignoring case like the
+// routing does.
+func FindModel(list []ModelEntry, id string) (ModelEntry, bool) {
+	for _, m := range list {
+		if strings.EqualFold(m.ID, id) {
+			return m, true
+		}
+	}
+	return ModelEntry{}, false
+}
+
+// knownModel reports whether model is an alias of the model mapper, a
+// serverless deployment or a deployment Azure listed.
+func knownModel(model string) bool {
+	lower := strings.ToLower(model)
+	if _, ok := ServerlessDeploymentInfo[lower]; ok {
+		return true
+	}
+	if _, ok := AzureOpenAIModelMapper[lower]; ok {
+		return true
+	}
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	for _, m := range models {
+		if strings.EqualFold(m.ID, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartModelRefresh loads the model list now and then every
+// ModelsRefreshInterval, so listing models never waits on Azure. Without
+// keys of its own the proxy has no list to keep, passthrough callers are
+// served lists fetched with their keys.
+func StartModelRefresh(ctx context.Context) {
+	if len(AzureKeys.Status()) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(ModelsRefreshInterval)
+		defer ticker.Stop()
+		for {
+			refreshModels(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// refreshModels replaces the model list. The previous list is kept when
+// Azure can't be reached.
+func refreshModels(ctx context.Context) {
+	key := AzureKeys.Next()
+	deployments, err := fetchDeployments(ctx, key)
+	if err != nil {
+		log.Printf("Error listing deployments: %v", err)
+		return
+	}
+	catalog, err := fetchModelCatalog(ctx, key)
+	if err != nil {
+		// Only the capabilities are missing, the deployments are still right.
+		log.Printf("Error listing models: %v", err)
+	}
+	list := listModels(deployments, catalog)
+	modelsMu.Lock()
+	models = list
+	modelsMu.Unlock()
+}
+
+// deployment is a deployment of the Azure resource and the model it serves.
+type deployment struct {
+	model   string
+	created int64
+}
+
+// catalogModel is a base model as Azure describes it.
+type catalogModel struct {
+	created      int64
+	capabilities Capabilities
+}
+
+// listModels builds the model list. Without deployments, before Azure
+// answered the first time, every alias of the model mapper is listed.
+func listModels(deployments map[string]deployment, catalog map[string]catalogModel) []ModelEntry {
+	list := []ModelEntry{}
+	seen := map[string]bool{}
+	add := func(id string, created int64, model string) {
+		if seen[strings.ToLower(id)] {
+			return
+		}
+		seen[strings.ToLower(id)] = true
+		e := ModelEntry{ID: id, Object: "model", Created: created, OwnedBy: "azure-openai"}
+		if c, ok := catalog[model]; ok {
+			if e.Created == 0 {
+				e.Created = c.created
+			}
+			e.Capabilities = &c.capabilities
+		}
+		list = append(list, e)
+	}
+
+	for name, d := range deployments {
+		add(name, d.created, d.model)
+	}
+	for alias, name := range AzureOpenAIModelMapper {
+		if deployments == nil {
+			add(alias, 0, alias)
+		} else if d, ok := deployments[name]; ok {
+			add(alias, d.created, d.model)
+		}
+	}
+	for name, d := range ServerlessDeploymentInfo {
+		if !seen[name] {
+			seen[name] = true
+			list = append(list, ModelEntry{ID: name, Object: "model", OwnedBy: "azure-ai", Capabilities: d.capabilities()})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func fetchDeployments(ctx context.Context, key string) (map[string]deployment, error) {
+	data, err := getAzure(ctx, key, "/openai/deployments", deploymentsAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	deployments := map[string]deployment{}
+	for _, d := range gjson.GetBytes(data, "data").Array() {
+		if status := d.Get("status").String(); status != "" && status != "succeeded" {
+			continue
+		}
+		deployments[d.Get("id").String()] = deployment{model: d.Get("model").String(), created: d.Get("created_at").Int()}
+	}
+	return deployments, nil
+}
+
+func fetchModelCatalog(ctx context.Context, key string) (map[string]catalogModel, error) {
+	data, err := getAzure(ctx, key, "/openai/models", AzureOpenAIModelsAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	catalog := map[string]catalogModel{}
+	for _, m := range gjson.GetBytes(data, "data").Array() {
+		c := m.Get("capabilities")
+		catalog[m.Get("id").String()] = catalogModel{
+			created: m.Get("created_at").Int(),
+			capabilities: Capabilities{
+				ChatCompletion: c.Get("chat_completion").Bool(),
+				Completion:     c.Get("completion").Bool(),
+				Embeddings:     c.Get("embeddings").Bool(),
+				FineTune:       c.Get("fine_tune").Bool(),
+				Inference:      c.Get("inference").Bool(),
+			},
+		}
+	}
+	return catalog, nil
+}
+
+// getAzure reads a listing of the Azure resource with key.
+func getAzure(ctx context.Context, key, path, apiVersion string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s?api-version=%s", strings.TrimSuffix(AzureOpenAIEndpoint, "/"), path, apiVersion), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("api-key", key)
+	res, err := upstream.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", path, res.StatusCode)
+	}
+	return data, nil
+}
@@ -0,0 +1,70 @@
+package azure
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/audit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+// observeResponse records upstream latency and wraps successful bodies so
+// token usage, time to first token and in-flight streams are tracked while
+// the body is relayed to the client. Streams that end without usage are
+// counted with the local tokenizer.
+func observeResponse(res *http.Response) {
+	ctx := res.Request.Context()
+	info := RequestInfoFromContext(ctx)
+	model, deployment := info.MetricLabels()
+	metrics.UpstreamLatency.WithLabelValues(info.Route, model, info.Backend).Observe(time.Since(info.UpstreamStart).Seconds())
+	observeLatency(info, res.StatusCode)
+	if info.Capture {
+		// Read along as the body is relayed, streams are not held back.
+		res.Body = audit.Capture(res.Body, func(data []byte, truncated bool) {
+			info.ResponseBody, info.ResponseTruncated = data, truncated
+		})
+	}
+	if res.StatusCode >= 300 {
+		return
+	}
+
+	sse := isEventStream(res.Header.Get("Content-Type"))
+	var onFirstByte func()
+	if sse {
+		metrics.InflightStreams.WithLabelValues(info.Route, model, info.Backend).Inc()
+		onFirstByte = func() {
+			metrics.TimeToFirstToken.WithLabelValues(info.Route, model, info.Backend).Observe(time.Since(info.UpstreamStart).Seconds())
+		}
+	}
+
+	id := auth.FromContext(ctx)
+	var text strings.Builder
+	tap := newUsageTap(res.Body, sse, onFirstByte, func(usage TokenUsage, found bool) {
+		if sse {
+			metrics.InflightStreams.WithLabelValues(info.Route, model, info.Backend).Dec()
+		}
+		if !found && sse && info.StreamRequest != nil {
+			// Upstream didn't report usage, count locally.
+			if usage, found = estimateUsage(info.Model, info.StreamRequest, text.String()); found {
+				metrics.EstimatedUsage.WithLabelValues(model, deployment).Inc()
+			}
+		}
+		if !found {
+			return
+		}
+		info.Usage = usage
+		metrics.Tokens.WithLabelValues(model, deployment, "prompt").Add(float64(usage.PromptTokens))
+		metrics.Tokens.WithLabelValues(model, deployment, "completion").Add(float64(usage.CompletionTokens))
+		metrics.Tokens.WithLabelValues(model, deployment, "reasoning").Add(float64(usage.ReasoningTokens))
+		metrics.Tokens.WithLabelValues(model, deployment, "cached").Add(float64(usage.CachedTokens))
+		if id != nil {
+			auth.Limits.RecordTokens(id, usage.TotalTokens)
+		}
+	})
+	if sse && info.StreamRequest != nil {
+		tap.text = &text
+	}
+	res.Body = tap
+}
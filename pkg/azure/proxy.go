@@ -11,9 +11,17 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/secrets"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+	"github.com/gyarbij/azure-oai-proxy/pkg/upstream"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -21,6 +29,7 @@ var (
 	AzureOpenAIModelsAPIVersion    = "2024-10-21"         // API version for fetching models
 	AzureOpenAIResponsesAPIVersion = "preview"            // API version for Responses API
 	AzureOpenAIEndpoint            = ""
+	AzureKeys                      *KeyPool // upstream keys used for callers authenticated by the proxy
 	ServerlessDeploymentInfo       = make(map[string]ServerlessDeployment)
 	AzureOpenAIModelMapper         = make(map[string]string)
 )
@@ -28,7 +37,27 @@ var (
 type ServerlessDeployment struct {
 	Name   string
 	Region string
-	Key    string
+	Keys   *KeyPool
+	Type   string // "chat", "completions" or "embeddings", empty when not configured
+}
+
+// capabilities returns what the deployment's model can do, nil when its
+// type wasn't configured.
+func (d ServerlessDeployment) capabilities() *Capabilities {
+	switch d.Type {
+	case "chat":
+		return &Capabilities{ChatCompletion: true, Inference: true}
+	case "completions":
+		return &Capabilities{Completion: true, Inference: true}
+	case "embeddings":
+		return &Capabilities{Embeddings: true, Inference: true}
+	}
+	return nil
+}
+
+// Host returns the hostname of the serverless endpoint.
+func (d ServerlessDeployment) Host() string {
+	return fmt.Sprintf("%s.%s.models.ai.azure.com", d.Name, d.Region)
 }
 
 func init() {
@@ -41,18 +70,44 @@ func init() {
 	if v := os.Getenv("AZURE_OPENAI_ENDPOINT"); v != "" {
 		AzureOpenAIEndpoint = v
 	}
+	// Several keys can be given comma-separated, requests are spread across them.
+	// The value may also be a secret reference such as file:/run/secrets/azure-key.
+	AzureKeys = NewKeyPool("azure", nil, validateAzureKey)
+	secrets.Watch(os.Getenv("AZURE_OPENAI_API_KEY"), func(v string) {
+		AzureKeys.SetKeys(strings.Split(v, ","))
+	})
+	KeysFile = os.Getenv("AZURE_OPENAI_KEYS_FILE")
+	if v := os.Getenv("AZURE_OPENAI_KEY_REVALIDATE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			KeyRevalidateInterval = d
+		}
+	}
 
 	if v := os.Getenv("AZURE_AI_STUDIO_DEPLOYMENTS"); v != "" {
 		for _, pair := range strings.Split(v, ",") {
 			info := strings.Split(pair, "=")
 			if len(info) == 2 {
+				// Deployment:region, optionally followed by :type
 				deploymentInfo := strings.Split(info[1], ":")
-				if len(deploymentInfo) == 2 {
-					ServerlessDeploymentInfo[strings.ToLower(info[0])] = ServerlessDeployment{
+				if len(deploymentInfo) == 2 || len(deploymentInfo) == 3 {
+					deployment := ServerlessDeployment{
 						Name:   deploymentInfo[0],
 						Region: deploymentInfo[1],
-						Key:    os.Getenv("AZURE_OPENAI_KEY_" + strings.ToUpper(info[0])),
 					}
+					if len(deploymentInfo) == 3 {
+						switch t := strings.ToLower(deploymentInfo[2]); t {
+						case "chat", "completions", "embeddings":
+							deployment.Type = t
+						default:
+							log.Printf("Unknown type %q of serverless deployment %s", deploymentInfo[2], info[0])
+						}
+					}
+					pool := NewKeyPool(strings.ToLower(info[0]), nil, serverlessKeyValidator(deployment))
+					secrets.Watch(os.Getenv("AZURE_OPENAI_KEY_"+strings.ToUpper(info[0])), func(v string) {
+						pool.SetKeys(strings.Split(v, ","))
+					})
+					deployment.Keys = pool
+					ServerlessDeploymentInfo[strings.ToLower(info[0])] = deployment
 				}
 			}
 		}
@@ -115,73 +170,127 @@ func NewOpenAIReverseProxy() *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
 		Director:       makeDirector(),
 		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		Transport:      &keyRetryTransport{base: tracing.Transport(backendTransport{})},
+		BufferPool:     upstream.BufferPool,
 	}
 }
 
 func HandleToken(req *http.Request) {
-	model := getModelFromRequest(req)
+	logger := logging.FromContext(req.Context())
+	model := GetModelFromRequest(req)
 	modelLower := strings.ToLower(model)
 	// Check if it's a serverless deployment
 	if info, ok := ServerlessDeploymentInfo[modelLower]; ok {
 		// Set the correct authorization header for serverless
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", info.Key))
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", info.Keys.Next()))
 		req.Header.Del("api-key")
-		log.Printf("Using serverless deployment authentication for %s", model)
-	} else {
-		// For regular Azure OpenAI deployments, use the api-key
-		apiKey := req.Header.Get("api-key")
+		logger.Debug("using serverless deployment key", "model", model)
+	} else if usesProxyKeys(req) {
+		// Use the proxy's own keys, those of the region the request is
+		// routed to.
+		_, pool := azureEndpoint(RequestInfoFromContext(req.Context()).Backend)
+		apiKey := pool.Next()
 		if apiKey == "" {
-			apiKey = req.Header.Get("Authorization")
-			if strings.HasPrefix(apiKey, "Bearer ") {
-				apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-			}
+			logger.Warn("AZURE_OPENAI_API_KEY is not set", "model", model)
 		}
+		req.Header.Set("api-key", apiKey)
+		req.Header.Del("Authorization")
+	} else {
+		// For regular Azure OpenAI deployments, use the api-key
+		apiKey := clientKey(req)
 		if apiKey == "" {
-			log.Printf("Warning: No api-key or Authorization header found for deployment: %s", model)
+			logger.Warn("no api-key or Authorization header found", "model", model)
 		} else {
 			req.Header.Set("api-key", apiKey)
 			req.Header.Del("Authorization")
-			log.Printf("Using regular Azure OpenAI authentication for %s", model)
+			logger.Debug("using client supplied Azure OpenAI key", "model", model)
 		}
 	}
 }
 
+// clientKey returns the Azure key a passthrough caller sent, as api-key or
+// as a bearer token.
+func clientKey(req *http.Request) string {
+	if key := req.Header.Get("api-key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
 func makeDirector() func(*http.Request) {
 	return func(req *http.Request) {
-		model := getModelFromRequest(req)
+		_, span := tracing.Start(req.Context(), "makeDirector")
+		defer span.End()
+
+		logger := logging.FromContext(req.Context())
+		model := GetModelFromRequest(req)
 		originURL := req.URL.String()
-		log.Printf("Original request URL: %s for model: %s", originURL, model)
 
 		// Check if this is a chat completion request for a model that should use Responses API
 		if strings.HasPrefix(req.URL.Path, "/v1/chat/completions") && shouldUseResponsesAPI(model) {
-			log.Printf("Redirecting %s from chat/completions to responses API", model)
+			logger.Debug("redirecting chat completion to responses API", "model", model)
 			// Convert the chat completion request to a responses request
 			convertChatToResponses(req)
+		} else {
+			requestStreamUsage(req, RequestInfoFromContext(req.Context()))
+		}
+
+		reqInfo := RequestInfoFromContext(req.Context())
+		reqInfo.Model = model
+		_, deployment := ResolveDeployment(model)
+		backends := Backends(req, model)
+		backend := backends[0]
+		if slices.Contains(backends, reqInfo.Backend) {
+			// Already picked by the handler or hedging.
+			backend = reqInfo.Backend
 		}
+		reqInfo.Backend, reqInfo.Deployment = backend, deployment
 
 		// Handle the token
 		HandleToken(req)
 
-		// Convert model to lowercase for case-insensitive matching
-		modelLower := strings.ToLower(model)
-
 		// Check if it's a serverless deployment
-		if info, ok := ServerlessDeploymentInfo[modelLower]; ok {
+		if info, ok := ServerlessDeploymentInfo[strings.ToLower(model)]; ok {
 			handleServerlessRequest(req, info, model)
-		} else if azureModel, ok := AzureOpenAIModelMapper[modelLower]; ok {
-			handleRegularRequest(req, azureModel)
 		} else {
-			log.Printf("Warning: Unknown model %s, treating as regular Azure OpenAI deployment", model)
-			handleRegularRequest(req, model)
+			if _, ok := AzureOpenAIModelMapper[strings.ToLower(model)]; !ok {
+				logger.Warn("unknown model, treating as regular Azure OpenAI deployment", "model", model)
+			}
+			endpoint, _ := azureEndpoint(reqInfo.Backend)
+			handleRegularRequest(req, endpoint, reqInfo.Deployment)
+		}
+		if id := logging.RequestID(req.Context()); id != "" {
+			req.Header.Set(apierror.RequestIDHeader, id)
 		}
+		reqInfo.UpstreamStart = time.Now()
+		logging.AddAttrs(req.Context(), "model", model, "deployment", reqInfo.Deployment, "backend", reqInfo.Backend)
+		span.SetAttributes(
+			attribute.String("gen_ai.request.model", model),
+			attribute.String("proxy.deployment", reqInfo.Deployment),
+			attribute.String("proxy.backend", reqInfo.Backend),
+		)
+
+		logging.FromContext(req.Context()).Debug("proxying request", "from", originURL, "to", req.URL.String(), "headers", sanitizeHeaders(req.Header))
+	}
+}
 
-		log.Printf("Proxying request [%s] %s -> %s", model, originURL, req.URL.String())
+// ResolveDeployment returns the backend ("azure" or the name of a serverless
+// deployment) and the deployment a model is routed to.
+func ResolveDeployment(model string) (backend, deployment string) {
+	modelLower := strings.ToLower(model)
+	if info, ok := ServerlessDeploymentInfo[modelLower]; ok {
+		return modelLower, info.Name
 	}
+	if azureModel, ok := AzureOpenAIModelMapper[modelLower]; ok {
+		return "azure", azureModel
+	}
+	return "azure", model
 }
 
 func handleServerlessRequest(req *http.Request, info ServerlessDeployment, model string) {
 	req.URL.Scheme = "https"
-	req.URL.Host = fmt.Sprintf("%s.%s.models.ai.azure.com", info.Name, info.Region)
+	req.URL.Host = info.Host()
 	req.Host = req.URL.Host // Preserve query parameters from the original request
 	originalQuery := req.URL.Query()
 	for key, values := range originalQuery {
@@ -190,14 +299,12 @@ func handleServerlessRequest(req *http.Request, info ServerlessDeployment, model
 		}
 	}
 
-	// Set the correct authorization header for serverless
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", info.Key))
-	req.Header.Del("api-key")
-	log.Printf("Using serverless deployment for %s", model)
+	// The authorization header was already set by HandleToken
+	logging.FromContext(req.Context()).Debug("using serverless deployment", "model", model, "host", req.URL.Host)
 }
 
-func handleRegularRequest(req *http.Request, deployment string) {
-	remote, _ := url.Parse(AzureOpenAIEndpoint)
+func handleRegularRequest(req *http.Request, endpoint, deployment string) {
+	remote, _ := url.Parse(endpoint)
 	req.URL.Scheme = remote.Scheme
 	req.URL.Host = remote.Host
 	req.Host = remote.Host
@@ -249,20 +356,18 @@ func handleRegularRequest(req *http.Request, deployment string) {
 	// Use the api-key from the original request for regular deployments
 	apiKey := req.Header.Get("api-key")
 	if apiKey == "" {
-		log.Printf("Warning: No api-key found for regular deployment: %s", deployment)
+		logging.FromContext(req.Context()).Warn("no api-key found for regular deployment", "deployment", deployment)
 	}
-	log.Printf("Using regular Azure OpenAI deployment for %s", deployment)
 }
 
-func getModelFromRequest(req *http.Request) string {
+// GetModelFromRequest returns the model a request is for, from the body or
+// the deployment in the path. Only the start of the body is read, see
+// modelFromBody.
+func GetModelFromRequest(req *http.Request) string {
 	// For Responses API, always check the body first
-	if strings.Contains(req.URL.Path, "/responses") && req.Body != nil {
-		body, _ := io.ReadAll(req.Body)
-		req.Body = io.NopCloser(bytes.NewBuffer(body))
-
+	if strings.Contains(req.URL.Path, "/responses") {
 		// The Responses API uses "model" field in the request body
-		model := gjson.GetBytes(body, "model").String()
-		if model != "" {
+		if model := modelFromBody(req); model != "" {
 			return model
 		}
 	}
@@ -276,25 +381,16 @@ func getModelFromRequest(req *http.Request) string {
 	}
 
 	// If not found in the path, try to get it from the request body
-	if req.Body != nil {
-		body, _ := io.ReadAll(req.Body)
-		req.Body = io.NopCloser(bytes.NewBuffer(body))
-		model := gjson.GetBytes(body, "model").String()
-		if model != "" {
-			return model
-		}
-	}
-
-	// If still not found, return an empty string
-	return ""
+	return modelFromBody(req)
 }
 
 func sanitizeHeaders(headers http.Header) http.Header {
 	sanitized := make(http.Header)
 	for key, values := range headers {
-		if key == "Authorization" || key == "api-key" {
+		switch http.CanonicalHeaderKey(key) {
+		case "Authorization", "Api-Key", "Cookie":
 			sanitized[key] = []string{"[REDACTED]"}
-		} else {
+		default:
 			sanitized[key] = values
 		}
 	}
@@ -302,6 +398,13 @@ func sanitizeHeaders(headers http.Header) http.Header {
 }
 
 func modifyResponse(res *http.Response) error {
+	observeResponse(res)
+	setUpstreamHeaders(res)
+	RecordRateLimits(res)
+	if RequestInfoFromContext(res.Request.Context()).StripUsage && isEventStream(res.Header.Get("Content-Type")) {
+		res.Body = newUsageChunkFilter(res.Body)
+	}
+
 	// Check if this is a streaming response that needs conversion
 	if res.Header.Get("Content-Type") == "text/event-stream" {
 		res.Header.Set("X-Accel-Buffering", "no")
@@ -324,10 +427,16 @@ func modifyResponse(res *http.Response) error {
 				defer pw.Close()
 				defer res.Body.Close()
 
+				_, span := tracing.Start(res.Request.Context(), "StreamingResponseConverter.Convert",
+					attribute.String("gen_ai.request.model", model))
+				defer span.End()
+
 				converter := NewStreamingResponseConverter(res.Body, pw, model)
 				if err := converter.Convert(); err != nil {
-					log.Printf("Streaming conversion error: %v", err)
+					logging.FromContext(res.Request.Context()).Error("streaming conversion failed", "error", err)
+					span.RecordError(err)
 				}
+				span.SetAttributes(attribute.Int("proxy.stream.chunks", converter.chunks))
 			}()
 
 			// Replace the response body
@@ -347,7 +456,13 @@ func modifyResponse(res *http.Response) error {
 
 	if res.StatusCode >= 400 {
 		body, _ := io.ReadAll(res.Body)
-		log.Printf("Azure API Error Response: Status: %d, Body: %s", res.StatusCode, string(body))
+		code := gjson.GetBytes(body, "error.code").String()
+		RecordError(res.Request, res.StatusCode, code, gjson.GetBytes(body, "error.message").String())
+		args := []any{"status", res.StatusCode, "error_code", code}
+		if logging.Bodies {
+			args = append(args, "body", logging.Body(body))
+		}
+		logging.FromContext(res.Request.Context()).Warn("upstream error response", args...)
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
 	}
 
@@ -372,10 +487,19 @@ func shouldUseResponsesAPI(model string) bool {
 
 // Function to convert chat completion request to responses format
 func convertChatToResponses(req *http.Request) {
+	_, span := tracing.Start(req.Context(), "convertChatToResponses")
+	defer span.End()
+
 	if req.Body != nil {
-		body, _ := io.ReadAll(req.Body)
+		body, err := readBody(req)
+		if err != nil {
+			return
+		}
 
-		log.Printf("Original chat completion request: %s", string(body))
+		logger := logging.FromContext(req.Context())
+		if logging.Bodies {
+			logger.Info("chat completion request", "body", logging.Body(body))
+		}
 
 		// Parse the chat completion request
 		model := gjson.GetBytes(body, "model").String()
@@ -427,7 +551,9 @@ func convertChatToResponses(req *http.Request) {
 		// Marshal the new body
 		newBodyBytes, _ := json.Marshal(newBody)
 
-		log.Printf("Converted to Responses API request: %s", string(newBodyBytes))
+		if logging.Bodies {
+			logger.Info("converted to responses API request", "body", logging.Body(newBodyBytes))
+		}
 
 		req.Body = io.NopCloser(bytes.NewBuffer(newBodyBytes))
 		req.ContentLength = int64(len(newBodyBytes))
@@ -441,18 +567,23 @@ func convertChatToResponses(req *http.Request) {
 
 // convert Responses API response to chat completion format
 func convertResponsesToChatCompletion(res *http.Response) {
+	_, span := tracing.Start(res.Request.Context(), "convertResponsesToChatCompletion")
+	defer span.End()
+
+	logger := logging.FromContext(res.Request.Context())
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
+		logger.Error("reading responses API response failed", "error", err)
 		return
 	}
 
-	// Log the raw response for debugging
-	log.Printf("Raw Responses API response: %s", string(body))
+	if logging.Bodies {
+		logger.Info("responses API response", "body", logging.Body(body))
+	}
 
 	var responseData map[string]interface{}
 	if err := json.Unmarshal(body, &responseData); err != nil {
-		log.Printf("Error unmarshaling response: %v", err)
+		logger.Error("unmarshaling responses API response failed", "error", err)
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
 		return
 	}
@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/secrets"
+)
+
+// Region is another Azure OpenAI resource with the same deployments as
+// AZURE_OPENAI_ENDPOINT, usually in another region. Requests for Azure
+// OpenAI models can be sent to any of them.
+type Region struct {
+	Name     string
+	Endpoint string
+	Keys     *KeyPool
+}
+
+// Regions are the resources of AZURE_OPENAI_REGIONS, in order.
+var Regions []Region
+
+func init() {
+	// name=endpoint, comma-separated. Keys are read from
+	// AZURE_OPENAI_KEY_<NAME> like those of serverless deployments.
+	if v := os.Getenv("AZURE_OPENAI_REGIONS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, endpoint, ok := strings.Cut(pair, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !ok || name == "" || name == "azure" {
+				log.Printf("Invalid region %q", pair)
+				continue
+			}
+			r := Region{Name: name, Endpoint: strings.TrimSpace(endpoint)}
+			r.Keys = NewKeyPool(name, nil, func(ctx context.Context, key string) error {
+				return checkAzureKey(ctx, r.Endpoint, key)
+			})
+			secrets.Watch(os.Getenv("AZURE_OPENAI_KEY_"+strings.ToUpper(name)), func(v string) {
+				r.Keys.SetKeys(strings.Split(v, ","))
+			})
+			Regions = append(Regions, r)
+			log.Printf("Loaded region %s: %s", r.Name, r.Endpoint)
+		}
+	}
+}
+
+func region(name string) (Region, bool) {
+	for _, r := range Regions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Region{}, false
+}
+
+// azureEndpoint returns the endpoint and keys of "azure" or a region.
+func azureEndpoint(backend string) (string, *KeyPool) {
+	if r, ok := region(backend); ok {
+		return r.Endpoint, r.Keys
+	}
+	return AzureOpenAIEndpoint, AzureKeys
+}
+
+// Backends returns the backends that can serve a request for model, the
+// best one by the Balance strategy first. Azure OpenAI models can go to
+// every region when the proxy's own keys are used, a key sent by the client
+// only works on AZURE_OPENAI_ENDPOINT.
+func Backends(req *http.Request, model string) []string {
+	backend, deployment := ResolveDeployment(model)
+	if backend != "azure" || !usesProxyKeys(req) {
+		return []string{backend}
+	}
+	return rank(append([]string{backend}, regionNames()...), deployment, RequestInfoFromContext(req.Context()).Affinity)
+}
+
+type internalKey struct{}
+
+// WithProxyKeys marks a request the proxy makes itself, e.g. to embed a
+// question for the semantic cache, so it is signed with the proxy's keys.
+func WithProxyKeys(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalKey{}, true)
+}
+
+// usesProxyKeys reports whether upstream keys come from the proxy's pools:
+// the caller authenticated against the proxy (their credentials are not
+// Azure keys and must never be forwarded upstream) or the proxy makes the
+// request itself. Passthrough callers always bring their own key.
+func usesProxyKeys(req *http.Request) bool {
+	internal, _ := req.Context().Value(internalKey{}).(bool)
+	return internal || auth.FromContext(req.Context()) != nil
+}
@@ -0,0 +1,64 @@
+package azure
+
+import (
+	"context"
+	"time"
+)
+
+// RequestInfo collects what the proxy learns about a request while handling
+// it: where it was routed, timings and token usage. It travels in the
+// request context from the handler through the director, transport and
+// response handling.
+type RequestInfo struct {
+	Route      string // route pattern, e.g. /v1/chat/completions
+	Model      string
+	Deployment string
+	Backend    string // "azure", a region or the name of a serverless deployment
+	Affinity   string // prompt prefix of the request under "affinity" balancing
+
+	// Reported by upstream, for support tickets.
+	UpstreamRequestID string
+	Region            string
+
+	Start         time.Time
+	UpstreamStart time.Time
+	Usage         TokenUsage
+	Retries       int
+
+	// Body of a streamed chat completion or completion, and whether the
+	// usage chunk the proxy asked for has to be removed from the stream.
+	StreamRequest []byte
+	StripUsage    bool
+
+	// Capture is set when the response body is kept for the audit log.
+	Capture           bool
+	ResponseBody      []byte
+	ResponseTruncated bool
+}
+
+// MetricLabels returns the model and deployment to label metrics with. The
+// model comes from the client, so models the proxy doesn't route to a known
+// deployment are all counted as "other" instead of each adding series.
+func (info *RequestInfo) MetricLabels() (model, deployment string) {
+	if !knownModel(info.Model) {
+		return "other", "other"
+	}
+	return info.Model, info.Deployment
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo attaches a new RequestInfo to ctx.
+func WithRequestInfo(ctx context.Context, route string) (context.Context, *RequestInfo) {
+	info := &RequestInfo{Route: route, Start: time.Now()}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// RequestInfoFromContext returns the request's info. Requests that didn't
+// come through the handler get a throwaway one so callers needn't check.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{Start: time.Now()}
+}
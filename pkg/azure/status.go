@@ -0,0 +1,216 @@
+package azure
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+)
+
+// maxErrorSamples is how many recent upstream errors are kept for the
+// admin status.
+const maxErrorSamples = 50
+
+// Status is the runtime state shown by the admin status endpoint.
+type Status struct {
+	Models     []ModelRoute      `json:"models"`
+	Backends   []BackendStatus   `json:"backends"`
+	RateLimits []RateLimitStatus `json:"rate_limits"`
+	Errors     []ErrorSample     `json:"errors"`
+}
+
+// ModelRoute is where requests for a model go.
+type ModelRoute struct {
+	Model      string `json:"model"`
+	Deployment string `json:"deployment"`
+	Backend    string `json:"backend"`
+}
+
+// BackendStatus describes a backend. Its breaker is open when every key
+// has been evicted, requests then only go out with the key evicted longest
+// ago until revalidation brings one back.
+type BackendStatus struct {
+	Name     string      `json:"name"`
+	Endpoint string      `json:"endpoint,omitempty"`
+	Breaker  string      `json:"breaker,omitempty"`
+	Keys     []KeyStatus `json:"keys,omitempty"`
+	InFlight int64       `json:"in_flight"`
+}
+
+// RateLimitStatus is what upstream last reported in the
+// x-ratelimit-remaining-* headers for a deployment.
+type RateLimitStatus struct {
+	Backend           string    `json:"backend"`
+	Deployment        string    `json:"deployment"`
+	RemainingRequests *int64    `json:"remaining_requests,omitempty"`
+	RemainingTokens   *int64    `json:"remaining_tokens,omitempty"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// ErrorSample is a recent upstream error.
+type ErrorSample struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Backend    string    `json:"backend"`
+	Deployment string    `json:"deployment,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Status     int       `json:"status"`
+	Code       string    `json:"code,omitempty"`
+	Message    string    `json:"message,omitempty"`
+}
+
+var (
+	inflight sync.Map // backend -> *atomic.Int64
+
+	statusMu     sync.Mutex
+	rateLimits   = map[string]*RateLimitStatus{} // by backend and deployment
+	errorSamples []ErrorSample
+)
+
+// BeginRequest counts a request to backend as in flight until the returned
+// function is called.
+func BeginRequest(backend string) (end func()) {
+	v, _ := inflight.LoadOrStore(backend, new(atomic.Int64))
+	n := v.(*atomic.Int64)
+	n.Add(1)
+	return func() { n.Add(-1) }
+}
+
+func inflightCount(backend string) int64 {
+	if v, ok := inflight.Load(backend); ok {
+		return v.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// RecordRateLimits keeps the remaining requests and tokens upstream
+// reported for the request's deployment.
+func RecordRateLimits(res *http.Response) {
+	requests, errR := strconv.ParseInt(res.Header.Get("x-ratelimit-remaining-requests"), 10, 64)
+	tokens, errT := strconv.ParseInt(res.Header.Get("x-ratelimit-remaining-tokens"), 10, 64)
+	if errR != nil && errT != nil {
+		return
+	}
+	info := RequestInfoFromContext(res.Request.Context())
+	rl := &RateLimitStatus{Backend: info.Backend, Deployment: info.Deployment, UpdatedAt: time.Now()}
+	if errR == nil {
+		rl.RemainingRequests = &requests
+	}
+	if errT == nil {
+		rl.RemainingTokens = &tokens
+	}
+
+	statusMu.Lock()
+	rateLimits[info.Backend+"/"+info.Deployment] = rl
+	statusMu.Unlock()
+}
+
+// RemainingTokens returns the tokens upstream last reported left for a
+// deployment. Readings older than the minute the limits are counted in
+// don't say anything anymore and are ignored.
+func RemainingTokens(backend, deployment string) (int64, bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	rl, ok := rateLimits[backend+"/"+deployment]
+	if !ok || rl.RemainingTokens == nil || time.Since(rl.UpdatedAt) > time.Minute {
+		return 0, false
+	}
+	return *rl.RemainingTokens, true
+}
+
+// RecordError keeps a sample of an upstream error.
+func RecordError(req *http.Request, status int, code, message string) {
+	info := RequestInfoFromContext(req.Context())
+	if len(message) > 200 {
+		message = message[:200] + "..."
+	}
+	sample := ErrorSample{
+		Time:       time.Now(),
+		RequestID:  logging.RequestID(req.Context()),
+		Backend:    info.Backend,
+		Deployment: info.Deployment,
+		Model:      info.Model,
+		Status:     status,
+		Code:       code,
+		Message:    message,
+	}
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	errorSamples = append(errorSamples, sample)
+	if len(errorSamples) > maxErrorSamples {
+		errorSamples = errorSamples[len(errorSamples)-maxErrorSamples:]
+	}
+}
+
+// CurrentStatus returns the routing table, the state of each backend and
+// the latest rate limits and errors, newest error first.
+func CurrentStatus() Status {
+	s := Status{Models: []ModelRoute{}, Backends: []BackendStatus{}, RateLimits: []RateLimitStatus{}}
+
+	for model := range AzureOpenAIModelMapper {
+		backend, deployment := ResolveDeployment(model)
+		s.Models = append(s.Models, ModelRoute{Model: model, Deployment: deployment, Backend: backend})
+	}
+	for name, info := range ServerlessDeploymentInfo {
+		if _, ok := AzureOpenAIModelMapper[name]; !ok {
+			s.Models = append(s.Models, ModelRoute{Model: name, Deployment: info.Name, Backend: name})
+		}
+	}
+	sort.Slice(s.Models, func(i, j int) bool { return s.Models[i].Model < s.Models[j].Model })
+
+	seen := map[string]bool{}
+	addBackend := func(name, endpoint string, pool *KeyPool) {
+		seen[name] = true
+		b := BackendStatus{Name: name, Endpoint: endpoint, InFlight: inflightCount(name)}
+		if pool != nil {
+			b.Keys = pool.Status()
+			b.Breaker = "closed"
+			if pool.Healthy() == 0 && len(b.Keys) > 0 {
+				b.Breaker = "open"
+			}
+		}
+		s.Backends = append(s.Backends, b)
+	}
+	if AzureOpenAIEndpoint != "" {
+		addBackend("azure", AzureOpenAIEndpoint, AzureKeys)
+	}
+	for _, r := range Regions {
+		addBackend(r.Name, r.Endpoint, r.Keys)
+	}
+	names := make([]string, 0, len(ServerlessDeploymentInfo))
+	for name := range ServerlessDeploymentInfo {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := ServerlessDeploymentInfo[name]
+		addBackend(name, "https://"+info.Host(), info.Keys)
+	}
+	// Backends outside the azure package, such as openai mode.
+	inflight.Range(func(k, _ any) bool {
+		if name := k.(string); !seen[name] {
+			addBackend(name, "", nil)
+		}
+		return true
+	})
+
+	statusMu.Lock()
+	for _, rl := range rateLimits {
+		s.RateLimits = append(s.RateLimits, *rl)
+	}
+	s.Errors = make([]ErrorSample, len(errorSamples))
+	for i, e := range errorSamples {
+		s.Errors[len(errorSamples)-1-i] = e
+	}
+	statusMu.Unlock()
+	sort.Slice(s.RateLimits, func(i, j int) bool {
+		a, b := s.RateLimits[i], s.RateLimits[j]
+		return a.Backend < b.Backend || a.Backend == b.Backend && a.Deployment < b.Deployment
+	})
+	return s
+}
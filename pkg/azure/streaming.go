@@ -15,6 +15,7 @@ type StreamingResponseConverter struct {
     reader io.Reader
     writer io.Writer
     model  string
+    chunks int // chunks written, for tracing
 }
 
 // NewStreamingResponseConverter creates a new streaming converter
@@ -131,6 +132,7 @@ func (c *StreamingResponseConverter) writeChunk(chunk map[string]interface{}) {
     c.writer.Write([]byte("data: "))
     c.writer.Write(chunkJSON)
     c.writer.Write([]byte("\n\n"))
+    c.chunks++
     
     if flusher, ok := c.writer.(flushWriter); ok {
         flusher.Flush()
@@ -0,0 +1,182 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func init() {
+	// Use the encodings compiled into the binary instead of downloading them.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// requestStreamUsage makes upstream report usage at the end of streamed
+// chat completions and completions by setting stream_options.include_usage.
+// When the client didn't ask for it itself, the usage chunk is stripped again
+// before it reaches the client.
+func requestStreamUsage(req *http.Request, info *RequestInfo) {
+	if req.Body == nil || !(strings.HasPrefix(req.URL.Path, "/v1/chat/completions") || strings.HasPrefix(req.URL.Path, "/v1/completions")) {
+		return
+	}
+	body, err := readBody(req)
+	if err != nil || !gjson.GetBytes(body, "stream").Bool() {
+		return
+	}
+
+	// Kept in case usage has to be estimated.
+	info.StreamRequest = body
+	if gjson.GetBytes(body, "stream_options.include_usage").Bool() {
+		return
+	}
+	if body, err = sjson.SetBytes(body, "stream_options.include_usage", true); err != nil {
+		return
+	}
+	info.StripUsage = true
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+}
+
+// usageChunkFilter drops the usage-only chunk (empty choices, usage set)
+// from a stream. Other events pass line by line as they arrive.
+type usageChunkFilter struct {
+	body    io.ReadCloser
+	in      bytes.Buffer // incomplete line
+	out     bytes.Buffer
+	dropped bool // the previous line was dropped, so is the blank line after it
+	err     error
+}
+
+func newUsageChunkFilter(body io.ReadCloser) *usageChunkFilter {
+	return &usageChunkFilter{body: body}
+}
+
+func (f *usageChunkFilter) Read(p []byte) (int, error) {
+	for f.out.Len() == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		n, err := f.body.Read(p)
+		f.in.Write(p[:n])
+		for {
+			i := bytes.IndexByte(f.in.Bytes(), '\n')
+			if i < 0 {
+				break
+			}
+			f.filter(f.in.Next(i + 1))
+		}
+		if err != nil {
+			if f.in.Len() > 0 {
+				f.filter(f.in.Next(f.in.Len()))
+			}
+			f.err = err
+		}
+	}
+	return f.out.Read(p)
+}
+
+func (f *usageChunkFilter) filter(line []byte) {
+	trimmed := bytes.TrimSpace(line)
+	if f.dropped && len(trimmed) == 0 {
+		f.dropped = false
+		return
+	}
+	f.dropped = false
+	if data, ok := bytes.CutPrefix(trimmed, []byte("data:")); ok && isUsageChunk(bytes.TrimSpace(data)) {
+		f.dropped = true
+		return
+	}
+	f.out.Write(line)
+}
+
+func (f *usageChunkFilter) Close() error {
+	return f.body.Close()
+}
+
+func isUsageChunk(data []byte) bool {
+	choices := gjson.GetBytes(data, "choices")
+	return gjson.GetBytes(data, "usage").IsObject() && choices.IsArray() && len(choices.Array()) == 0
+}
+
+// collectStreamText appends the generated text of a chat completion or
+// completion chunk to text, for estimating usage.
+func collectStreamText(text *strings.Builder, data []byte) {
+	for _, choice := range gjson.GetBytes(data, "choices").Array() {
+		text.WriteString(choice.Get("delta.content").String())
+		text.WriteString(choice.Get("text").String())
+		for _, call := range choice.Get("delta.tool_calls").Array() {
+			text.WriteString(call.Get("function.name").String())
+			text.WriteString(call.Get("function.arguments").String())
+		}
+	}
+}
+
+var encodings sync.Map // encoding name -> *tiktoken.Tiktoken
+
+// encodingFor returns the tokenizer of model, o200k_base for models the
+// tokenizer doesn't know (newer ones all use it).
+func encodingFor(model string) *tiktoken.Tiktoken {
+	name := tiktoken.MODEL_O200K_BASE
+	if enc, ok := tiktoken.MODEL_TO_ENCODING[strings.ToLower(model)]; ok {
+		name = enc
+	} else {
+		for prefix, enc := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+			if strings.HasPrefix(strings.ToLower(model), prefix) {
+				name = enc
+				break
+			}
+		}
+	}
+	if enc, ok := encodings.Load(name); ok {
+		return enc.(*tiktoken.Tiktoken)
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil
+	}
+	encodings.Store(name, enc)
+	return enc
+}
+
+// estimateUsage counts the tokens of a streamed request and of the text it
+// generated locally, for streams upstream sent no usage for.
+func estimateUsage(model string, request []byte, completion string) (TokenUsage, bool) {
+	enc := encodingFor(model)
+	if enc == nil {
+		return TokenUsage{}, false
+	}
+	count := func(s string) int { return len(enc.EncodeOrdinary(s)) }
+
+	var usage TokenUsage
+	if messages := gjson.GetBytes(request, "messages"); messages.IsArray() {
+		// Per-message overhead as documented for the chat format.
+		for _, m := range messages.Array() {
+			usage.PromptTokens += 3 + count(m.Get("role").String())
+			if content := m.Get("content"); content.IsArray() {
+				for _, part := range content.Array() {
+					usage.PromptTokens += count(part.Get("text").String())
+				}
+			} else {
+				usage.PromptTokens += count(content.String())
+			}
+			if name := m.Get("name").String(); name != "" {
+				usage.PromptTokens += 1 + count(name)
+			}
+		}
+		usage.PromptTokens += 3
+	} else {
+		for _, p := range gjson.GetBytes(request, "prompt").Array() {
+			usage.PromptTokens += count(p.String())
+		}
+	}
+	usage.CompletionTokens = count(completion)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage, true
+}
@@ -0,0 +1,169 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/upstream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// backendTransport sends requests over the shared transport of the backend
+// they are routed to.
+type backendTransport struct{}
+
+func (backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return upstream.Transport(RequestInfoFromContext(req.Context()).Backend).RoundTrip(req)
+}
+
+// maxRetryBody is the largest request body kept in memory to be resent with
+// another key. Larger bodies are streamed and not retried.
+const maxRetryBody = 4 << 20
+
+// keyRetryTransport evicts upstream keys that Azure rejects and retries the
+// request with the next key of the same pool, so a revoked or rotated key
+// doesn't surface to clients as a stretch of 401s.
+type keyRetryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *keyRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool, header := poolForRequest(req)
+	key := upstreamKey(req, header)
+	if pool == nil || !pool.Contains(key) {
+		// Client supplied key in passthrough mode, nothing to rotate.
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1)); err != nil {
+			return nil, err
+		}
+		if len(body) > maxRetryBody {
+			// Too large to keep around for a retry (uploads), send it once.
+			attempt := req.Clone(req.Context())
+			attempt.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			res, err := t.base.RoundTrip(attempt)
+			if err == nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) {
+				pool.Evict(key, res.StatusCode)
+			}
+			return res, err
+		}
+		req.Body.Close()
+	}
+
+	tried := map[string]bool{}
+	for {
+		tried[key] = true
+		attempt := req.Clone(req.Context())
+		if body != nil {
+			attempt.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		setUpstreamKey(attempt, header, key)
+
+		res, err := t.base.RoundTrip(attempt)
+		if err != nil || (res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden) {
+			return res, err
+		}
+
+		pool.Evict(key, res.StatusCode)
+		next := pool.Next()
+		if tried[next] || pool.Healthy() == 0 {
+			return res, nil
+		}
+		res.Body.Close()
+		logging.FromContext(req.Context()).Warn("retrying with next key", "pool", pool.name, "status", res.StatusCode)
+		metrics.Retries.WithLabelValues(pool.name, "key_rejected").Inc()
+		RequestInfoFromContext(req.Context()).Retries++
+		trace.SpanFromContext(req.Context()).AddEvent("retry", trace.WithAttributes(
+			attribute.String("proxy.retry.reason", "key_rejected"),
+			attribute.Int("http.response.status_code", res.StatusCode),
+		))
+		key = next
+	}
+}
+
+// poolForRequest finds the key pool of the backend an outgoing request is
+// addressed to and the header its key is sent in.
+func poolForRequest(req *http.Request) (*KeyPool, string) {
+	if remote, err := url.Parse(AzureOpenAIEndpoint); err == nil && remote.Host == req.URL.Host {
+		return AzureKeys, "api-key"
+	}
+	for _, r := range Regions {
+		if remote, err := url.Parse(r.Endpoint); err == nil && remote.Host == req.URL.Host {
+			return r.Keys, "api-key"
+		}
+	}
+	for _, info := range ServerlessDeploymentInfo {
+		if info.Host() == req.URL.Host {
+			return info.Keys, "Authorization"
+		}
+	}
+	return nil, ""
+}
+
+func upstreamKey(req *http.Request, header string) string {
+	return strings.TrimPrefix(req.Header.Get(header), "Bearer ")
+}
+
+func setUpstreamKey(req *http.Request, header, key string) {
+	if header == "Authorization" {
+		req.Header.Set(header, "Bearer "+key)
+	} else {
+		req.Header.Set(header, key)
+	}
+}
+
+// validateAzureKey checks a key against the cheap models listing endpoint.
+func validateAzureKey(ctx context.Context, key string) error {
+	return checkAzureKey(ctx, AzureOpenAIEndpoint, key)
+}
+
+func checkAzureKey(ctx context.Context, endpoint, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/openai/models?api-version=%s", strings.TrimSuffix(endpoint, "/"), AzureOpenAIModelsAPIVersion), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("api-key", key)
+	return checkKeyResponse(req)
+}
+
+// serverlessKeyValidator checks a key against the deployment's info endpoint.
+func serverlessKeyValidator(info ServerlessDeployment) func(context.Context, string) error {
+	return func(ctx context.Context, key string) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://"+info.Host()+"/info", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		return checkKeyResponse(req)
+	}
+}
+
+// checkKeyResponse only fails on authentication errors, other statuses say
+// nothing about the key.
+func checkKeyResponse(req *http.Request) error {
+	res, err := upstream.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
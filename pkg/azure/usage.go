@@ -0,0 +1,153 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// maxTappedJSON bounds how much of a non-streaming body is kept to read its
+// usage, larger bodies (embeddings of big batches) are passed on unparsed.
+const maxTappedJSON = 8 << 20
+
+// TokenUsage is the token usage reported upstream for a request.
+type TokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	ReasoningTokens  int
+	CachedTokens     int // prompt tokens served from Azure's prompt cache
+	TotalTokens      int
+}
+
+// parseUsage reads a usage object from a Chat Completions, Completions,
+// Embeddings or Responses API payload, or from a Responses API stream event.
+func parseUsage(data []byte) (TokenUsage, bool) {
+	u := gjson.GetBytes(data, "usage")
+	if !u.IsObject() {
+		// response.completed stream events nest the response
+		if u = gjson.GetBytes(data, "response.usage"); !u.IsObject() {
+			return TokenUsage{}, false
+		}
+	}
+
+	usage := TokenUsage{
+		PromptTokens:     int(u.Get("prompt_tokens").Int() + u.Get("input_tokens").Int()),
+		CompletionTokens: int(u.Get("completion_tokens").Int() + u.Get("output_tokens").Int()),
+		ReasoningTokens:  int(u.Get("completion_tokens_details.reasoning_tokens").Int() + u.Get("output_tokens_details.reasoning_tokens").Int()),
+		CachedTokens:     int(u.Get("prompt_tokens_details.cached_tokens").Int() + u.Get("input_tokens_details.cached_tokens").Int()),
+		TotalTokens:      int(u.Get("total_tokens").Int()),
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage, true
+}
+
+// usageTap passes a response body through unchanged while picking the
+// usage out of it. SSE bodies are scanned line by line so streams are never
+// held back, JSON bodies are parsed once fully read.
+type usageTap struct {
+	body io.ReadCloser
+	sse  bool
+
+	buf      bytes.Buffer // partial SSE line, or the JSON body so far
+	overflow bool
+	usage    TokenUsage
+	found    bool
+	started  bool
+	done     bool
+	text     *strings.Builder // generated text of a stream, collected if set
+
+	onFirstByte func()
+	onDone      func(usage TokenUsage, found bool)
+}
+
+func newUsageTap(body io.ReadCloser, sse bool, onFirstByte func(), onDone func(TokenUsage, bool)) *usageTap {
+	return &usageTap{body: body, sse: sse, onFirstByte: onFirstByte, onDone: onDone}
+}
+
+func (t *usageTap) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 {
+		if !t.started {
+			t.started = true
+			if t.onFirstByte != nil {
+				t.onFirstByte()
+			}
+		}
+		t.observe(p[:n])
+	}
+	if err == io.EOF {
+		t.finish()
+	}
+	return n, err
+}
+
+func (t *usageTap) Close() error {
+	t.finish()
+	return t.body.Close()
+}
+
+func (t *usageTap) observe(chunk []byte) {
+	if !t.sse {
+		if t.overflow || t.buf.Len()+len(chunk) > maxTappedJSON {
+			t.overflow = true
+			t.buf.Reset()
+		} else {
+			t.buf.Write(chunk)
+		}
+		return
+	}
+
+	t.buf.Write(chunk)
+	for {
+		line, err := t.buf.ReadBytes('\n')
+		if err != nil {
+			// Incomplete line, keep it for the next chunk.
+			rest := append([]byte(nil), line...)
+			t.buf.Reset()
+			t.buf.Write(rest)
+			return
+		}
+		t.observeLine(line)
+	}
+}
+
+func (t *usageTap) observeLine(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if t.text != nil {
+		collectStreamText(t.text, data)
+	}
+	if !bytes.Contains(data, []byte(`"usage"`)) {
+		return
+	}
+	if u, ok := parseUsage(data); ok {
+		t.usage, t.found = u, true
+	}
+}
+
+func (t *usageTap) finish() {
+	if t.done {
+		return
+	}
+	t.done = true
+	if t.sse {
+		t.observeLine(t.buf.Bytes())
+	} else if !t.overflow && t.buf.Len() > 0 {
+		t.usage, t.found = parseUsage(t.buf.Bytes())
+	}
+	t.buf = bytes.Buffer{}
+	if t.onDone != nil {
+		t.onDone(t.usage, t.found)
+	}
+}
+
+func isEventStream(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream")
+}
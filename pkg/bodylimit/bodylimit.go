@@ -0,0 +1,104 @@
+package bodylimit
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+)
+
+var (
+	// Default is the largest request body accepted on routes without their
+	// own limit, 0 is unlimited.
+	Default int64 = 32 << 20
+	// Routes holds the limits of single routes, by route pattern or path.
+	// The defaults follow what Azure itself accepts.
+	Routes = map[string]int64{
+		"/v1/audio/transcriptions": 25 << 20,
+		"/v1/audio/translations":   25 << 20,
+		"/v1/files":                512 << 20,
+	}
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_BODY_SIZE"); v != "" {
+		if n, err := ParseSize(v); err == nil {
+			Default = n
+		} else {
+			log.Printf("Invalid AZURE_OPENAI_PROXY_MAX_BODY_SIZE: %v", err)
+		}
+	}
+	// route=size, comma-separated
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_BODY_SIZES"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			route, size, ok := strings.Cut(pair, "=")
+			if !ok {
+				continue
+			}
+			n, err := ParseSize(size)
+			if err != nil {
+				log.Printf("Invalid body size for %s: %v", route, err)
+				continue
+			}
+			Routes[strings.TrimSpace(route)] = n
+		}
+	}
+}
+
+// ParseSize parses a byte count with an optional KB, MB or GB suffix.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, suffix)), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// Limit returns the body limit of a request, 0 if unlimited.
+func Limit(c *gin.Context) int64 {
+	if n, ok := Routes[c.FullPath()]; ok {
+		return n
+	}
+	if n, ok := Routes[c.Request.URL.Path]; ok {
+		return n
+	}
+	return Default
+}
+
+// Middleware rejects requests whose body exceeds the route's limit with 413.
+// Bodies of unknown length are cut off at the limit while they are read,
+// the proxy's error handlers turn that into a 413 too.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := Limit(c)
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			Reject(c.Writer, limit)
+			c.Abort()
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// Reject answers with 413 for a body over limit bytes.
+func Reject(w http.ResponseWriter, limit int64) {
+	apierror.Write(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large", fmt.Sprintf("Request body exceeds the limit of %d bytes", limit))
+}
@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/bodylimit"
+)
+
+var (
+	// Target selects the cache: "memory", or "disk:<path>" for a bbolt file
+	// behind the in-memory LRU. The cache is disabled when empty.
+	Target = ""
+	// DefaultTTL applies to the routes cached by default.
+	DefaultTTL = time.Hour
+	// TTLs overrides the TTL by "route" or "route:model". A TTL of 0 turns
+	// caching off for that route or model.
+	TTLs = map[string]time.Duration{}
+	// MaxSize bounds the memory used by cached responses.
+	MaxSize int64 = 256 << 20
+	// MaxEntrySize is the largest response that is cached.
+	MaxEntrySize int64 = 8 << 20
+	// Scope decides who shares cached responses: "key" (each caller only
+	// sees its own), "team" or "global".
+	Scope = "key"
+)
+
+// Header tells clients whether a response came from the cache.
+const Header = "x-proxy-cache"
+
+// defaultRoutes are cached with DefaultTTL unless TTLs says otherwise.
+var defaultRoutes = []string{"/v1/embeddings", "/v1/chat/completions", "/v1/completions"}
+
+func init() {
+	Target = os.Getenv("AZURE_OPENAI_PROXY_CACHE")
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_CACHE_TTL")); err == nil {
+		DefaultTTL = v
+	}
+	for _, route := range defaultRoutes {
+		TTLs[route] = DefaultTTL
+	}
+	// route[:model]=ttl, comma-separated
+	if v := os.Getenv("AZURE_OPENAI_PROXY_CACHE_TTLS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, ttl, ok := strings.Cut(pair, "=")
+			if !ok {
+				continue
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(ttl))
+			if err != nil {
+				log.Printf("Invalid cache TTL for %s: %v", name, err)
+				continue
+			}
+			TTLs[strings.TrimSpace(name)] = d
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_CACHE_MAX_SIZE"); v != "" {
+		if n, err := bodylimit.ParseSize(v); err == nil {
+			MaxSize = n
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_CACHE_MAX_ENTRY"); v != "" {
+		if n, err := bodylimit.ParseSize(v); err == nil {
+			MaxEntrySize = n
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_CACHE_SCOPE"); v != "" {
+		Scope = v
+	}
+}
+
+// Entry is a cached response.
+type Entry struct {
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	StoredAt    time.Time `json:"stored_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Age returns the Age header value of an entry.
+func (e *Entry) Age() string {
+	return strconv.Itoa(int(time.Since(e.StoredAt).Seconds()))
+}
+
+func (e *Entry) size() int64 {
+	return int64(len(e.Body) + len(e.ContentType))
+}
+
+// Store holds cached entries.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, e *Entry)
+}
+
+var store Store
+
+// Start opens the cache configured by Target. It does nothing when caching
+// is disabled.
+func Start(ctx context.Context) error {
+	if Target == "" {
+		return nil
+	}
+	mem := NewMemory(MaxSize)
+	switch {
+	case Target == "memory":
+		store = mem
+	case strings.HasPrefix(Target, "disk:"):
+		disk, err := OpenDisk(ctx, strings.TrimPrefix(Target, "disk:"))
+		if err != nil {
+			return err
+		}
+		store = &tiered{mem: mem, disk: disk}
+	default:
+		return fmt.Errorf("unknown cache %q", Target)
+	}
+	log.Printf("Response cache enabled: %s", Target)
+	return nil
+}
+
+// Enabled reports whether responses are cached.
+func Enabled() bool {
+	return store != nil
+}
+
+// TTL returns how long responses of a route and model are cached, 0 if they
+// aren't.
+func TTL(route, model string) time.Duration {
+	if d, ok := TTLs[route+":"+model]; ok {
+		return d
+	}
+	return TTLs[route]
+}
+
+// Get returns the cached entry for key unless it has expired.
+func Get(key string) (*Entry, bool) {
+	if store == nil {
+		return nil, false
+	}
+	e, ok := store.Get(key)
+	if !ok || time.Now().After(e.ExpiresAt) {
+		return nil, false
+	}
+	return e, true
+}
+
+// Set caches a response for ttl.
+func Set(key, contentType string, body []byte, ttl time.Duration) {
+	if store == nil || int64(len(body)) > MaxEntrySize {
+		return
+	}
+	now := time.Now()
+	store.Set(key, &Entry{ContentType: contentType, Body: body, StoredAt: now, ExpiresAt: now.Add(ttl)})
+}
+
+// Key builds the cache key of a request from the caller's scope, the
+// deployment it goes to and its normalized body.
+func Key(scope, deployment, route string, body []byte) (string, error) {
+	normalized, err := Normalize(body)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", scope, deployment, route)
+	h.Write(normalized)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Normalize re-encodes a JSON body with sorted keys and without fields
+// that don't change the response, so equal requests map to the same key
+// however the client formatted them.
+func Normalize(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v map[string]any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	delete(v, "user")
+	return json.Marshal(v)
+}
+
+// ScopeOf returns the scope a caller's cached responses are shared in.
+// Callers the proxy didn't authenticate are told apart by the upstream
+// credential they sent.
+func ScopeOf(id *auth.Identity, credential string) string {
+	switch {
+	case Scope == "global":
+		return ""
+	case id != nil && Scope == "team" && id.Team != "":
+		return "team:" + id.Team
+	}
+	return KeyScope(id, credential)
+}
+
+// KeyScope is the narrowest scope: a single virtual key, or the upstream
+// credential without proxy auth.
+func KeyScope(id *auth.Identity, credential string) string {
+	if id != nil {
+		return "key:" + id.ID
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return "credential:" + hex.EncodeToString(sum[:])
+}
+
+// Deterministic reports whether a request may be answered from the cache.
+// Sampled completions differ on every call and are only cached when the
+// request sets temperature 0.
+func Deterministic(route string, temperature *float64) bool {
+	switch route {
+	case "/v1/chat/completions", "/v1/completions", "/v1/responses":
+		return temperature != nil && *temperature == 0
+	}
+	return true
+}
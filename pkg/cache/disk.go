@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var entriesBucket = []byte("entries")
+
+// Disk keeps entries in a bbolt file so they survive restarts. Expired
+// entries are removed every ten minutes.
+type Disk struct {
+	db *bolt.DB
+}
+
+func OpenDisk(ctx context.Context, path string) (*Disk, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening cache %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	d := &Disk{db: db}
+	go d.sweep(ctx)
+	return d, nil
+}
+
+func (d *Disk) Get(key string) (*Entry, bool) {
+	var e Entry
+	found := false
+	err := d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(entriesBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &e)
+	})
+	if err != nil || !found {
+		return nil, false
+	}
+	return &e, true
+}
+
+func (d *Disk) Set(key string, e *Entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(key), data)
+	})
+	if err != nil {
+		log.Printf("Error writing cache entry: %v", err)
+	}
+}
+
+func (d *Disk) sweep(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			d.db.Close()
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		removed := 0
+		err := d.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(entriesBucket)
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				var e struct {
+					ExpiresAt time.Time `json:"expires_at"`
+				}
+				if json.Unmarshal(v, &e) != nil || now.After(e.ExpiresAt) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed = len(expired)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error removing expired cache entries: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d expired cache entries", removed)
+		}
+	}
+}
+
+// tiered serves from memory first and falls back to disk, entries read
+// from disk are kept in memory again.
+type tiered struct {
+	mem  *Memory
+	disk *Disk
+}
+
+func (t *tiered) Get(key string) (*Entry, bool) {
+	if e, ok := t.mem.Get(key); ok {
+		return e, true
+	}
+	e, ok := t.disk.Get(key)
+	if ok {
+		t.mem.Set(key, e)
+	}
+	return e, ok
+}
+
+func (t *tiered) Set(key string, e *Entry) {
+	t.mem.Set(key, e)
+	t.disk.Set(key, e)
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is an LRU of entries bounded by their total size.
+type Memory struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List // front is most recently used
+	items   map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+func NewMemory(maxSize int64) *Memory {
+	return &Memory{maxSize: maxSize, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (m *Memory) Get(key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (m *Memory) Set(key string, e *Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.remove(el)
+	}
+	if e.size() > m.maxSize {
+		return
+	}
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, entry: e})
+	m.size += e.size()
+	for m.size > m.maxSize {
+		m.remove(m.order.Back())
+	}
+}
+
+func (m *Memory) remove(el *list.Element) {
+	item := m.order.Remove(el).(*memoryItem)
+	delete(m.items, item.key)
+	m.size -= item.entry.size()
+}
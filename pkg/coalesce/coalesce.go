@@ -0,0 +1,101 @@
+package coalesce
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/bodylimit"
+)
+
+var (
+	// Routes are the routes whose identical in-flight requests share one
+	// upstream call. Coalescing is disabled when empty.
+	Routes = map[string]bool{}
+	// MaxResponseSize is the largest response that is shared. Waiting
+	// requests make their own call when the response is larger.
+	MaxResponseSize int64 = 8 << 20
+)
+
+// Header marks responses that were shared from another request's call.
+const Header = "x-proxy-coalesced"
+
+func init() {
+	// comma-separated routes, e.g. /v1/embeddings,/v1/chat/completions
+	for _, route := range strings.Split(os.Getenv("AZURE_OPENAI_PROXY_COALESCE"), ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			Routes[route] = true
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_COALESCE_MAX_RESPONSE"); v != "" {
+		if n, err := bodylimit.ParseSize(v); err == nil {
+			MaxResponseSize = n
+		}
+	}
+	if len(Routes) > 0 {
+		log.Printf("Coalescing identical requests on %d routes", len(Routes))
+	}
+}
+
+// Enabled reports whether requests to route are coalesced.
+func Enabled(route string) bool {
+	return Routes[route]
+}
+
+// Response is what a call returned, replayed to the requests that waited
+// on it.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Flight is an upstream call identical requests wait on.
+type Flight struct {
+	key  string
+	done chan struct{}
+	res  *Response
+}
+
+var (
+	mu      sync.Mutex
+	flights = map[string]*Flight{}
+)
+
+// Join returns the flight of the call for key. The first request to join
+// leads: it makes the call and must Finish the flight.
+func Join(key string) (f *Flight, leader bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if f, ok := flights[key]; ok {
+		return f, false
+	}
+	f = &Flight{key: key, done: make(chan struct{})}
+	flights[key] = f
+	return f, true
+}
+
+// Wait returns the leader's response. It is nil when the response can't be
+// shared, the request then makes its own call. When ctx ends first Wait
+// returns its error.
+func (f *Flight) Wait(ctx context.Context) (*Response, error) {
+	select {
+	case <-f.done:
+		return f.res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Finish hands res to the waiting requests, nil if it can't be shared.
+// Requests arriving afterwards start a new flight.
+func (f *Flight) Finish(res *Response) {
+	mu.Lock()
+	delete(flights, f.key)
+	mu.Unlock()
+	f.res = res
+	close(f.done)
+}
@@ -0,0 +1,165 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// Interval is how often the checks run. Probes hit upstream, so results
+	// are cached in between instead of checking on every /readyz call.
+	Interval = 30 * time.Second
+	// Timeout bounds a single check.
+	Timeout = 10 * time.Second
+)
+
+// Status of a check. Only failed checks make the proxy unready, degraded
+// ones (upstream outages, throttling) would take every replica out at once.
+type Status string
+
+const (
+	OK       Status = "ok"
+	Degraded Status = "degraded"
+	Failed   Status = "fail"
+)
+
+// Check is a named health check. Returning an error fails the check unless
+// it is wrapped with MarkDegraded.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of the last run of a check.
+type Result struct {
+	Name      string    `json:"name"`
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+// Report is the combined state of all checks.
+type Report struct {
+	Status    Status    `json:"status"`
+	Ready     bool      `json:"ready"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	Checks    []Result  `json:"checks"`
+}
+
+type degraded struct{ error }
+
+func (d degraded) Unwrap() error { return d.error }
+
+// MarkDegraded wraps err so the check reports degraded instead of failed.
+func MarkDegraded(err error) error {
+	if err == nil {
+		return nil
+	}
+	return degraded{err}
+}
+
+var (
+	mu     sync.RWMutex
+	checks []Check
+	report Report
+)
+
+func init() {
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_HEALTH_INTERVAL")); err == nil && v > 0 {
+		Interval = v
+	}
+}
+
+// Register adds checks. Call before Start.
+func Register(c ...Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	checks = append(checks, c...)
+}
+
+// Start runs the checks now and then every Interval until ctx is done.
+func Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(Interval)
+		defer ticker.Stop()
+		for {
+			run(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// run executes all checks concurrently and replaces the cached report.
+func run(ctx context.Context) {
+	mu.RLock()
+	list := checks
+	mu.RUnlock()
+
+	results := make([]Result, len(list))
+	var wg sync.WaitGroup
+	for i, c := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	next := Report{Status: OK, Ready: true, CheckedAt: time.Now(), Checks: results}
+	for _, r := range results {
+		switch r.Status {
+		case Failed:
+			next.Status, next.Ready = Failed, false
+		case Degraded:
+			if next.Status == OK {
+				next.Status = Degraded
+			}
+		}
+	}
+
+	mu.Lock()
+	if report.Ready && !next.Ready {
+		log.Printf("Health checks failing, reporting not ready")
+	} else if !report.Ready && next.Ready && !report.CheckedAt.IsZero() {
+		log.Printf("Health checks passing again, reporting ready")
+	}
+	report = next
+	mu.Unlock()
+}
+
+func runCheck(ctx context.Context, c Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := c.Run(ctx)
+	r := Result{Name: c.Name, Status: OK, CheckedAt: start, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		r.Status, r.Error = Failed, err.Error()
+		if errors.As(err, &degraded{}) {
+			r.Status = Degraded
+		}
+	}
+	return r
+}
+
+// Current returns the cached report. Before the first run completes the
+// proxy is not ready.
+func Current() Report {
+	mu.RLock()
+	defer mu.RUnlock()
+	if report.CheckedAt.IsZero() {
+		return Report{Status: Failed, Checks: []Result{}}
+	}
+	return report
+}
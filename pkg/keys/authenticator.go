@@ -0,0 +1,44 @@
+package keys
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+)
+
+// Authenticator accepts virtual keys sent as "Authorization: Bearer" or in
+// the "api-key" header, the two ways OpenAI and Azure clients send keys.
+type Authenticator struct {
+	store *Store
+}
+
+func NewAuthenticator(store *Store) *Authenticator {
+	return &Authenticator{store: store}
+}
+
+func (a *Authenticator) Authenticate(req *http.Request) (*auth.Identity, error) {
+	secret := req.Header.Get("api-key")
+	if secret == "" {
+		secret = strings.TrimSpace(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	}
+	if !strings.HasPrefix(secret, SecretPrefix) {
+		return nil, auth.ErrNoCredentials
+	}
+
+	k, err := a.store.Lookup(secret)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, errors.New("unknown virtual key")
+		}
+		return nil, err
+	}
+	if k.Revoked {
+		return nil, errors.New("virtual key " + k.ID + " is revoked")
+	}
+	if k.Expired() {
+		return nil, errors.New("virtual key " + k.ID + " has expired")
+	}
+	return k.Identity(), nil
+}
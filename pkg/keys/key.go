@@ -0,0 +1,77 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+)
+
+// SecretPrefix marks virtual keys issued by the proxy so they can be told
+// apart from Azure keys and JWTs without a database lookup.
+const SecretPrefix = "sk-proxy-"
+
+// Key is a virtual key issued by the proxy. The secret itself is never
+// stored, only its SHA-256 hash.
+type Key struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name,omitempty"`
+	Owner             string     `json:"owner,omitempty"`
+	Team              string     `json:"team,omitempty"`
+	AllowedModels     []string   `json:"allowed_models,omitempty"`
+	RequestsPerMinute int        `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   int        `json:"tokens_per_minute,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	CapturePrompts    bool       `json:"capture_prompts,omitempty"`
+	Priority          string     `json:"priority,omitempty"`
+	Weight            int        `json:"weight,omitempty"`
+	Revoked           bool       `json:"revoked"`
+	Prefix            string     `json:"prefix"` // start of the secret, to recognise keys in listings
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// Expired reports whether the key is past its expiry time.
+func (k *Key) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// Identity converts the key into the identity used for permissions and limits.
+func (k *Key) Identity() *auth.Identity {
+	return &auth.Identity{
+		ID:                "key:" + k.ID,
+		Subject:           k.Owner,
+		Team:              k.Team,
+		Source:            "key",
+		AllowedModels:     k.AllowedModels,
+		RequestsPerMinute: k.RequestsPerMinute,
+		TokensPerMinute:   k.TokensPerMinute,
+		CapturePrompts:    k.CapturePrompts,
+		Priority:          k.Priority,
+		Weight:            k.Weight,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return SecretPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func secretPrefix(secret string) string {
+	return secret[:len(SecretPrefix)+6]
+}
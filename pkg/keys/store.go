@@ -0,0 +1,214 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// DBPath is where virtual keys are persisted, next to the binary by default.
+	DBPath = "keys.db"
+
+	ErrNotFound = errors.New("key not found")
+)
+
+var (
+	keysBucket   = []byte("keys")   // id -> record
+	hashesBucket = []byte("hashes") // secret hash -> id
+)
+
+func init() {
+	if exe, err := os.Executable(); err == nil {
+		DBPath = filepath.Join(filepath.Dir(exe), "keys.db")
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_KEYS_DB"); v != "" {
+		DBPath = v
+	}
+}
+
+// record is the stored form of a key, including the hash of its secret.
+type record struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+// Store persists virtual keys in an embedded bbolt database.
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening key store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(keysBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(hashesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Printf("Opened virtual key store: %s", path)
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create stores k under a new id and returns the generated secret. The
+// secret is only ever available from this call and from Rotate.
+func (s *Store) Create(k Key) (*Key, string, error) {
+	now := time.Now().UTC()
+	k.ID = newID()
+	k.Revoked = false
+	k.CreatedAt = now
+	k.UpdatedAt = now
+
+	secret := newSecret()
+	k.Prefix = secretPrefix(secret)
+	rec := record{Key: k, Hash: hashSecret(secret)}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := put(tx, &rec); err != nil {
+			return err
+		}
+		return tx.Bucket(hashesBucket).Put([]byte(rec.Hash), []byte(rec.ID))
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &rec.Key, secret, nil
+}
+
+func (s *Store) Get(id string) (*Key, error) {
+	var rec *record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = get(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec.Key, nil
+}
+
+func (s *Store) List() ([]Key, error) {
+	list := []Key{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(_, v []byte) error {
+			var rec record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			list = append(list, rec.Key)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Update applies fn to the key with the given id and persists the result.
+func (s *Store) Update(id string, fn func(*Key)) (*Key, error) {
+	var rec *record
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if rec, err = get(tx, id); err != nil {
+			return err
+		}
+		fn(&rec.Key)
+		rec.ID = id
+		rec.UpdatedAt = time.Now().UTC()
+		return put(tx, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec.Key, nil
+}
+
+// Rotate replaces the secret of a key. The old secret stops working at once.
+func (s *Store) Rotate(id string) (*Key, string, error) {
+	secret := newSecret()
+	var rec *record
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if rec, err = get(tx, id); err != nil {
+			return err
+		}
+		hashes := tx.Bucket(hashesBucket)
+		if err := hashes.Delete([]byte(rec.Hash)); err != nil {
+			return err
+		}
+		rec.Hash = hashSecret(secret)
+		rec.Prefix = secretPrefix(secret)
+		rec.UpdatedAt = time.Now().UTC()
+		if err := hashes.Put([]byte(rec.Hash), []byte(rec.ID)); err != nil {
+			return err
+		}
+		return put(tx, rec)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &rec.Key, secret, nil
+}
+
+// Revoke disables a key permanently. The record is kept for auditing.
+func (s *Store) Revoke(id string) (*Key, error) {
+	return s.Update(id, func(k *Key) {
+		k.Revoked = true
+	})
+}
+
+// Lookup returns the key a secret belongs to.
+func (s *Store) Lookup(secret string) (*Key, error) {
+	hash := hashSecret(secret)
+	var rec *record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(hashesBucket).Get([]byte(hash))
+		if id == nil {
+			return ErrNotFound
+		}
+		var err error
+		rec, err = get(tx, string(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec.Key, nil
+}
+
+func get(tx *bolt.Tx, id string) (*record, error) {
+	v := tx.Bucket(keysBucket).Get([]byte(id))
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	var rec record
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func put(tx *bolt.Tx, rec *record) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(keysBucket).Put([]byte(rec.ID), v)
+}
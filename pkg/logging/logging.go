@@ -0,0 +1,214 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+)
+
+var (
+	// Level is the minimum level logged: debug, info, warn or error.
+	Level = "info"
+	// Format is "json" or "text".
+	Format = "json"
+	// Bodies enables logging of request and response bodies. Prompts and
+	// completions are never logged unless this is set.
+	Bodies = false
+	// MaxBody is how many bytes of a body are logged at most.
+	MaxBody = 4096
+)
+
+// redactions are applied to logged bodies. Custom patterns come from
+// AZURE_OPENAI_PROXY_LOG_REDACT.
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)"(api[-_]?key|authorization|password|secret|token|access_token|refresh_token)"\s*:\s*"[^"]*"`), `"$1":"[REDACTED]"`},
+	{regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`), "Bearer [REDACTED]"},
+	{regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}`), "[REDACTED]"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED_EMAIL]"},
+}
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_LOG_LEVEL"); v != "" {
+		Level = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_LOG_FORMAT"); v != "" {
+		Format = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("AZURE_OPENAI_PROXY_LOG_BODIES")); err == nil {
+		Bodies = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_LOG_BODY_MAX")); err == nil && v > 0 {
+		MaxBody = v
+	}
+	for _, p := range strings.Split(os.Getenv("AZURE_OPENAI_PROXY_LOG_REDACT"), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			log.Fatalf("Invalid AZURE_OPENAI_PROXY_LOG_REDACT pattern %q: %v", p, err)
+		}
+		redactions = append(redactions, struct {
+			re   *regexp.Regexp
+			repl string
+		}{re, "[REDACTED]"})
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(Level)); err != nil {
+		log.Fatalf("Invalid AZURE_OPENAI_PROXY_LOG_LEVEL %q", Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	// Also routes the standard library logger through the handler.
+	slog.SetDefault(slog.New(handler))
+}
+
+// Body prepares a request or response body for logging: credentials, email
+// addresses and custom patterns are redacted and the result is truncated to
+// MaxBody. Callers check Bodies first.
+func Body(body []byte) string {
+	s := string(body)
+	if len(s) > MaxBody+256 {
+		// Leave some slack so a secret cut at the boundary still matches.
+		s = s[:MaxBody+256]
+	}
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	if len(s) > MaxBody {
+		s = s[:MaxBody]
+	}
+	if len(body) > MaxBody {
+		s += "...(" + strconv.Itoa(len(body)) + " bytes)"
+	}
+	return s
+}
+
+// requestLog holds the logger of a request and the fields collected for its
+// access log line.
+type requestLog struct {
+	id     string
+	mu     sync.Mutex
+	logger *slog.Logger
+	attrs  []any
+}
+
+type requestLogKey struct{}
+
+// FromContext returns the request's logger, carrying its request id and any
+// fields added so far, or the default logger outside of a request.
+func FromContext(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// RequestID returns the id assigned to the request by Middleware.
+func RequestID(ctx context.Context) string {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.id
+	}
+	return ""
+}
+
+// Fork returns a context for work done on behalf of the request, such as
+// the upstream calls it is split into. It logs with the request's logger,
+// but fields added to it don't end up in the request's access log line.
+func Fork(ctx context.Context) context.Context {
+	rl, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, requestLogKey{}, &requestLog{id: rl.id, logger: FromContext(ctx)})
+}
+
+// AddAttrs adds key-value pairs to the request's access log line and to
+// everything logged through its logger from now on.
+func AddAttrs(ctx context.Context, args ...any) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		rl.logger = rl.logger.With(args...)
+		rl.attrs = append(rl.attrs, args...)
+	}
+}
+
+// Middleware assigns every request an id, taken from the client's
+// X-Request-ID when it sent a usable one, and a logger and writes one
+// access log line when it completes.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(apierror.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(apierror.RequestIDHeader, id)
+		rl := &requestLog{id: id, logger: slog.Default().With("request_id", id)}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestLogKey{}, rl))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+
+		rl.mu.Lock()
+		args := append([]any{
+			"request_id", id,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}, rl.attrs...)
+		rl.mu.Unlock()
+		slog.Log(c.Request.Context(), level, "request completed", args...)
+	}
+}
+
+// validRequestID accepts ids of up to 128 printable ASCII characters, so
+// client supplied ids can't inject anything into headers or logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "azure_oai_proxy"
+
+var (
+	// Requests counts finished requests.
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Proxied requests by route, model, deployment, backend and status code.",
+	}, []string{"route", "model", "deployment", "backend", "status"})
+
+	// UpstreamLatency measures the time until the upstream response headers
+	// arrive, including retries.
+	UpstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_latency_seconds",
+		Help:      "Time until upstream response headers were received.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"route", "model", "backend"})
+
+	// TimeToFirstToken measures the time until the first body bytes of a
+	// streamed response arrive.
+	TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time until the first chunk of a streamed response was received.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"route", "model", "backend"})
+
+	// Tokens counts token usage reported upstream, by type (prompt,
+	// completion, reasoning, and cached prompt tokens).
+	Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Tokens reported in response usage, by type.",
+	}, []string{"model", "deployment", "type"})
+
+	// InflightStreams is the number of streamed responses being relayed.
+	InflightStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_streams",
+		Help:      "Streamed responses currently being relayed.",
+	}, []string{"route", "model", "backend"})
+
+	// Retries counts upstream attempts repeated by the proxy.
+	Retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Upstream requests retried by the proxy, by backend and reason.",
+	}, []string{"backend", "reason"})
+
+	// EstimatedUsage counts streams whose usage was counted by the proxy
+	// because upstream didn't report it.
+	EstimatedUsage = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "estimated_usage_total",
+		Help:      "Streamed responses without upstream usage whose tokens were estimated locally.",
+	}, []string{"model", "deployment"})
+
+	// CacheRequests counts response cache lookups by result (hit, miss,
+	// bypass).
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Response cache lookups by route and result: hit, miss or bypass.",
+	}, []string{"route", "result"})
+
+	// SemanticCacheRequests counts semantic cache lookups by result (hit,
+	// miss, error).
+	SemanticCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_requests_total",
+		Help:      "Semantic cache lookups by model and result: hit, miss or error.",
+	}, []string{"model", "result"})
+
+	// SemanticCacheSimilarity is the similarity of the closest cached
+	// question found by each lookup.
+	SemanticCacheSimilarity = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "semantic_cache_similarity",
+		Help:      "Cosine similarity of the closest cached question per semantic cache lookup.",
+		Buckets:   []float64{0.5, 0.7, 0.8, 0.85, 0.9, 0.92, 0.94, 0.95, 0.96, 0.97, 0.98, 0.99, 1},
+	}, []string{"model"})
+
+	// CoalescedRequests counts requests answered with the response of an
+	// identical request's upstream call.
+	CoalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Requests that shared the upstream call of an identical in-flight request, by route.",
+	}, []string{"route"})
+
+	// EmbeddingsCalls counts upstream calls made for embeddings requests
+	// that were split or micro-batched.
+	EmbeddingsCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "embeddings_calls_total",
+		Help:      "Upstream calls made for split or micro-batched embeddings requests, by model and deployment.",
+	}, []string{"model", "deployment"})
+
+	// HedgedRequests counts hedged requests by result: primary_won,
+	// hedge_won, or over_budget when the budget didn't allow the hedge.
+	HedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hedged_requests_total",
+		Help:      "Requests slow enough to be hedged, by model and result: primary_won, hedge_won or over_budget.",
+	}, []string{"model", "result"})
+
+	// QueueDepth is the number of requests waiting for a deployment or
+	// backend with limited concurrency.
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Requests waiting for capacity, by deployment or backend and priority.",
+	}, []string{"name", "priority"})
+
+	// QueueWait measures how long queued requests waited, whether they were
+	// admitted or not.
+	QueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time requests spent waiting for capacity, by deployment or backend and priority.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"name", "priority"})
+
+	// QueueRejected counts requests turned away by the queue (full, timeout).
+	QueueRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_rejected_total",
+		Help:      "Requests rejected because the queue was full or they waited too long, by deployment or backend, priority and reason.",
+	}, []string{"name", "priority", "reason"})
+
+	// AuditRecords counts audit records by result (written, failed, dropped).
+	AuditRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_records_total",
+		Help:      "Audit records by result: written, failed or dropped because the queue was full.",
+	}, []string{"result"})
+)
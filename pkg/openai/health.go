@@ -0,0 +1,54 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/health"
+	"github.com/gyarbij/azure-oai-proxy/pkg/upstream"
+)
+
+// HealthChecks returns the readiness checks for the OpenAI endpoint. The
+// key is only checked when the proxy has one of its own.
+func HealthChecks() []health.Check {
+	checks := []health.Check{{Name: "config", Run: checkConfig}}
+	if OpenAIAPIKey.Get() != "" {
+		checks = append(checks, health.Check{Name: "credentials/openai", Run: checkCredentials})
+	}
+	return checks
+}
+
+func checkConfig(ctx context.Context) error {
+	u, err := url.Parse(OpenAIEndpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("OPENAI_API_ENDPOINT %q is not a valid URL", OpenAIEndpoint)
+	}
+	return nil
+}
+
+// checkCredentials lists models, which costs no tokens.
+func checkCredentials(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(OpenAIEndpoint, "/")+"/v1/models", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+OpenAIAPIKey.Get())
+	res, err := upstream.Client.Do(req)
+	if err != nil {
+		return health.MarkDegraded(err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("OpenAI returned %d", res.StatusCode)
+	default:
+		return health.MarkDegraded(fmt.Errorf("OpenAI returned %d", res.StatusCode))
+	}
+}
@@ -0,0 +1,32 @@
+package openai
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxModelLabels bounds the models that get their own metrics label.
+const maxModelLabels = 100
+
+var (
+	labelsMu    sync.Mutex
+	modelLabels = map[string]bool{}
+)
+
+// MetricModel returns the label to count a request for model under. There
+// is no list of OpenAI's models to check against, so a model gets its own
+// label once OpenAI answered a request for it successfully, up to
+// maxModelLabels of them. Everything else is "other", clients can't add
+// series by making up model names.
+func MetricModel(model string, status int) string {
+	model = strings.ToLower(model)
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	if !modelLabels[model] {
+		if status >= 300 || len(modelLabels) >= maxModelLabels {
+			return "other"
+		}
+		modelLabels[model] = true
+	}
+	return model
+}
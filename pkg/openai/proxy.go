@@ -3,16 +3,26 @@ package openai
 import (
     "os"
 	"bytes"
+    "errors"
     "io"
     "log"
     "net/http"
     "net/http/httputil"
     "net/url"
     "strings"
+
+    "github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+    "github.com/gyarbij/azure-oai-proxy/pkg/auth"
+    "github.com/gyarbij/azure-oai-proxy/pkg/bodylimit"
+    "github.com/gyarbij/azure-oai-proxy/pkg/logging"
+    "github.com/gyarbij/azure-oai-proxy/pkg/secrets"
+    "github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+    "github.com/gyarbij/azure-oai-proxy/pkg/upstream"
 )
 
 var (
     OpenAIEndpoint = "https://api.openai.com"
+    OpenAIAPIKey   *secrets.Value // upstream key used for callers authenticated by the proxy
 )
 
 func init() {
@@ -20,6 +30,7 @@ func init() {
     if v := os.Getenv("OPENAI_API_ENDPOINT"); v != "" {
         OpenAIEndpoint = v
     }
+    OpenAIAPIKey = secrets.NewValue(os.Getenv("OPENAI_API_KEY"))
 }
 
 func NewOpenAIReverseProxy() *httputil.ReverseProxy {
@@ -27,6 +38,8 @@ func NewOpenAIReverseProxy() *httputil.ReverseProxy {
         Director:       makeDirector(),
         ModifyResponse: modifyResponse,
         ErrorHandler:   errorHandler,
+        Transport:      tracing.Transport(upstream.Transport("openai")),
+        BufferPool:     upstream.BufferPool,
     }
 }
 
@@ -59,12 +72,22 @@ func makeDirector() func(*http.Request) {
         
         // Add OpenAI-specific headers if needed
         req.Header.Set("User-Agent", "Azure-OAI-Proxy/1.0")
+        if id := logging.RequestID(req.Context()); id != "" {
+            req.Header.Set(apierror.RequestIDHeader, id)
+        }
         
-        log.Printf("Proxying request [OpenAI] %s -> %s", originURL, req.URL.String())
+        logging.FromContext(req.Context()).Debug("proxying request", "from", originURL, "to", req.URL.String())
     }
 }
 
 func handleAuthorization(req *http.Request) {
+    // Callers authenticated by the proxy use the proxy's own OpenAI key
+    if auth.FromContext(req.Context()) != nil {
+        req.Header.Set("Authorization", "Bearer "+OpenAIAPIKey.Get())
+        req.Header.Del("api-key")
+        return
+    }
+
     // Ensure the Authorization header is properly formatted
     auth := req.Header.Get("Authorization")
     if auth != "" && !strings.HasPrefix(auth, "Bearer ") {
@@ -77,10 +100,21 @@ func handleAuthorization(req *http.Request) {
 }
 
 func modifyResponse(res *http.Response) error {
+    // The client gets the proxy's request id, OpenAI's own is passed on
+    if id := res.Header.Get(apierror.RequestIDHeader); id != "" {
+        res.Header.Del(apierror.RequestIDHeader)
+        res.Header.Set("x-proxy-upstream-request-id", id)
+        logging.AddAttrs(res.Request.Context(), "upstream_request_id", id)
+    }
+    
     // Log errors for debugging
     if res.StatusCode >= 400 {
         body, _ := io.ReadAll(res.Body)
-        log.Printf("OpenAI API Error Response: Status: %d, Body: %s", res.StatusCode, string(body))
+        args := []any{"status", res.StatusCode}
+        if logging.Bodies {
+            args = append(args, "body", logging.Body(body))
+        }
+        logging.FromContext(res.Request.Context()).Warn("upstream error response", args...)
         res.Body = io.NopCloser(bytes.NewBuffer(body))
     }
     
@@ -95,12 +129,13 @@ func modifyResponse(res *http.Response) error {
 }
 
 func errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
-    log.Printf("OpenAI proxy error: %v", err)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        bodylimit.Reject(rw, tooLarge.Limit)
+        return
+    }
+    logging.FromContext(req.Context()).Error("OpenAI proxy error", "error", err)
     
     // Return a proper error response
-    rw.Header().Set("Content-Type", "application/json")
-    rw.WriteHeader(http.StatusBadGateway)
-    
-    errorResponse := `{"error": {"message": "Failed to connect to OpenAI API", "type": "proxy_error", "code": "bad_gateway"}}`
-    rw.Write([]byte(errorResponse))
+    apierror.Write(rw, http.StatusBadGateway, "proxy_error", "bad_gateway", "Failed to connect to OpenAI API")
 }
\ No newline at end of file
@@ -0,0 +1,387 @@
+package queue
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/apierror"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	// Limits caps the requests in flight per deployment or backend. Names
+	// without a limit aren't queued.
+	Limits = map[string]Limit{}
+	// DefaultQueueSize is how many requests may wait for a limit that
+	// doesn't set its own queue size.
+	DefaultQueueSize = 100
+	// Timeout is how long a request waits in the queue at most.
+	Timeout = 30 * time.Second
+	// LowPriorityMinTokens holds low priority requests back while upstream
+	// reports fewer remaining tokens for their deployment, leaving them to
+	// the other classes. Off when 0.
+	LowPriorityMinTokens int64
+)
+
+// PriorityHeader lets clients lower the priority of a request.
+const PriorityHeader = "x-proxy-priority"
+
+// Limit is the concurrency of a deployment or backend and the size of its
+// queue.
+type Limit struct {
+	MaxConcurrency int // 0 is unlimited
+	QueueSize      int
+}
+
+var (
+	ErrQueueFull = errors.New("queue is full")
+	ErrTimeout   = errors.New("timed out waiting in queue")
+)
+
+func init() {
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_QUEUE_SIZE")); err == nil && v >= 0 {
+		DefaultQueueSize = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_QUEUE_TIMEOUT")); err == nil && v > 0 {
+		Timeout = v
+	}
+	if v, err := strconv.ParseInt(os.Getenv("AZURE_OPENAI_PROXY_LOW_PRIORITY_MIN_TOKENS"), 10, 64); err == nil && v > 0 {
+		LowPriorityMinTokens = v
+	}
+	// name=max_concurrency[:queue_size], comma-separated
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_CONCURRENCY"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				continue
+			}
+			conc, size, hasSize := strings.Cut(value, ":")
+			limit := Limit{QueueSize: DefaultQueueSize}
+			var err error
+			if limit.MaxConcurrency, err = strconv.Atoi(strings.TrimSpace(conc)); err != nil || limit.MaxConcurrency <= 0 {
+				log.Printf("Invalid max concurrency for %s: %q", name, value)
+				continue
+			}
+			if hasSize {
+				if limit.QueueSize, err = strconv.Atoi(strings.TrimSpace(size)); err != nil || limit.QueueSize < 0 {
+					log.Printf("Invalid queue size for %s: %q", name, value)
+					continue
+				}
+			}
+			Limits[strings.TrimSpace(name)] = limit
+		}
+	}
+}
+
+// Priority is the scheduling class of a request. Waiting requests of a
+// higher class are always served first.
+type Priority int
+
+const (
+	High Priority = iota
+	Normal
+	Low
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+// ParsePriority parses "high", "normal" or "low".
+func ParsePriority(s string) (Priority, bool) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return Priority(p), true
+		}
+	}
+	return Normal, false
+}
+
+// Request describes a request to the scheduler.
+type Request struct {
+	Backend    string
+	Deployment string
+	Priority   Priority
+	// Flow is the caller. Callers of the same class share capacity in
+	// proportion to their Weight.
+	Flow   string
+	Weight int
+}
+
+// limiter admits requests up to the concurrency of a limit and queues the
+// rest. Higher classes go first, within a class callers take turns by
+// start-time fair queuing: each request is tagged with the virtual time its
+// caller's previous requests have used up, the lowest tag is served next.
+type limiter struct {
+	name    string
+	limit   Limit
+	mu      sync.Mutex
+	active  int
+	queued  int
+	classes [numPriorities]class
+}
+
+type class struct {
+	flows map[string]*flow
+	vtime float64 // tag of the request served last
+	depth int
+}
+
+type flow struct {
+	waiting *list.List // of *waiter
+	finish  float64    // tag the flow's next request starts at
+}
+
+type waiter struct {
+	req     Request
+	tag     float64
+	flow    *flow
+	el      *list.Element
+	ready   chan struct{}
+	granted bool
+	evicted bool // made room for a request of a higher class
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*limiter{}
+)
+
+// limiterFor returns the limiter of a deployment, or of its backend when
+// the deployment has no limit of its own. Low priority requests to
+// unlimited deployments still wait while they are throttled.
+func limiterFor(r Request) *limiter {
+	name := r.Deployment
+	limit, ok := Limits[name]
+	if !ok {
+		if limit, ok = Limits[r.Backend]; ok {
+			name = r.Backend
+		} else if r.Priority == Low && LowPriorityMinTokens > 0 {
+			limit = Limit{QueueSize: DefaultQueueSize}
+		} else {
+			return nil
+		}
+	}
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[name]
+	if !ok {
+		l = &limiter{name: name, limit: limit}
+		for p := range l.classes {
+			l.classes[p].flows = map[string]*flow{}
+		}
+		limiters[name] = l
+	}
+	return l
+}
+
+// throttled reports whether low priority requests to a deployment are held
+// back because its token budget is running out.
+func throttled(r Request) bool {
+	if r.Priority != Low || LowPriorityMinTokens == 0 {
+		return false
+	}
+	remaining, ok := azure.RemainingTokens(r.Backend, r.Deployment)
+	return ok && remaining < LowPriorityMinTokens
+}
+
+// Acquire waits until the request may be sent and returns the function that
+// gives its slot back. It fails with ErrQueueFull or ErrTimeout, or the
+// context's error when the client went away first.
+func Acquire(ctx context.Context, r Request) (release func(), err error) {
+	l := limiterFor(r)
+	if l == nil {
+		return func() {}, nil
+	}
+	if r.Weight <= 0 {
+		r.Weight = 1
+	}
+
+	l.mu.Lock()
+	if l.queued == 0 && l.hasCapacity() && !throttled(r) {
+		l.active++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if l.queued >= l.limit.QueueSize && !l.evictBelow(r.Priority) {
+		l.mu.Unlock()
+		metrics.QueueRejected.WithLabelValues(l.name, r.Priority.String(), "full").Inc()
+		return nil, ErrQueueFull
+	}
+	w := l.enqueue(r)
+	l.dispatch()
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+	// Throttled requests are looked at again as the token budget recovers.
+	var recheck <-chan time.Time
+	if r.Priority == Low && LowPriorityMinTokens > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		recheck = ticker.C
+	}
+wait:
+	for {
+		select {
+		case <-w.ready:
+			break wait
+		case <-recheck:
+			l.mu.Lock()
+			l.dispatch()
+			l.mu.Unlock()
+		case <-timer.C:
+			err = ErrTimeout
+			break wait
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		}
+	}
+	metrics.QueueWait.WithLabelValues(l.name, r.Priority.String()).Observe(time.Since(start).Seconds())
+
+	l.mu.Lock()
+	granted, evicted := w.granted, w.evicted
+	if !granted && !evicted {
+		l.remove(w)
+	}
+	l.mu.Unlock()
+	switch {
+	case evicted:
+		metrics.QueueRejected.WithLabelValues(l.name, r.Priority.String(), "full").Inc()
+		return nil, ErrQueueFull
+	case granted && ctx.Err() != nil:
+		// The slot came through as the client went away.
+		l.release()
+		return nil, ctx.Err()
+	case granted:
+		return l.release, nil
+	case err == ErrTimeout:
+		metrics.QueueRejected.WithLabelValues(l.name, r.Priority.String(), "timeout").Inc()
+	}
+	return nil, err
+}
+
+func (l *limiter) hasCapacity() bool {
+	return l.limit.MaxConcurrency == 0 || l.active < l.limit.MaxConcurrency
+}
+
+// enqueue tags a request and adds it to its caller's flow. l.mu must be held.
+func (l *limiter) enqueue(r Request) *waiter {
+	c := &l.classes[r.Priority]
+	f, ok := c.flows[r.Flow]
+	if !ok {
+		// A caller that was idle starts at the current virtual time.
+		f = &flow{waiting: list.New(), finish: c.vtime}
+		c.flows[r.Flow] = f
+	}
+	w := &waiter{req: r, tag: max(c.vtime, f.finish), flow: f, ready: make(chan struct{})}
+	f.finish = w.tag + 1/float64(r.Weight)
+	w.el = f.waiting.PushBack(w)
+	l.queued++
+	c.depth++
+	metrics.QueueDepth.WithLabelValues(l.name, r.Priority.String()).Set(float64(c.depth))
+	return w
+}
+
+// remove takes a waiter out of the queue. l.mu must be held.
+func (l *limiter) remove(w *waiter) {
+	c := &l.classes[w.req.Priority]
+	w.flow.waiting.Remove(w.el)
+	if w.flow.waiting.Len() == 0 {
+		delete(c.flows, w.req.Flow)
+	}
+	l.queued--
+	c.depth--
+	metrics.QueueDepth.WithLabelValues(l.name, w.req.Priority.String()).Set(float64(c.depth))
+}
+
+// next returns the waiter to serve next: the lowest tag among the first
+// requests of each flow of the highest class that has any, skipping
+// throttled ones. l.mu must be held.
+func (l *limiter) next() *waiter {
+	for p := range l.classes {
+		var best *waiter
+		for _, f := range l.classes[p].flows {
+			w := f.waiting.Front().Value.(*waiter)
+			if throttled(w.req) {
+				continue
+			}
+			if best == nil || w.tag < best.tag {
+				best = w
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+// dispatch admits waiters while there is capacity. l.mu must be held.
+func (l *limiter) dispatch() {
+	for l.hasCapacity() {
+		w := l.next()
+		if w == nil {
+			return
+		}
+		l.remove(w)
+		l.classes[w.req.Priority].vtime = w.tag
+		l.active++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// evictBelow makes room in a full queue by turning away the newest request
+// of the lowest class below p. l.mu must be held.
+func (l *limiter) evictBelow(p Priority) bool {
+	for q := numPriorities - 1; q > p; q-- {
+		var newest *waiter
+		for _, f := range l.classes[q].flows {
+			w := f.waiting.Back().Value.(*waiter)
+			if newest == nil || w.tag > newest.tag {
+				newest = w
+			}
+		}
+		if newest != nil {
+			l.remove(newest)
+			newest.evicted = true
+			close(newest.ready)
+			return true
+		}
+	}
+	return false
+}
+
+// release gives a slot back and admits the next waiter.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.dispatch()
+}
+
+// Reject answers a request the queue turned away: 429 when the queue is
+// full, 503 when it waited too long.
+func Reject(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	if errors.Is(err, ErrQueueFull) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_error", "queue_full", "Too many requests are waiting for this deployment, retry later")
+		return
+	}
+	apierror.Write(w, http.StatusServiceUnavailable, "server_error", "queue_timeout", "Timed out waiting for capacity on this deployment, retry later")
+}
@@ -0,0 +1,87 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// vaultStub serves secrets the way Key Vault does.
+type vaultStub struct {
+	mu     sync.Mutex
+	values map[string]string
+	fail   bool
+}
+
+func (s *vaultStub) set(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+}
+
+func (s *vaultStub) setFailing(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer vault-token" || r.URL.Query().Get("api-version") != "7.4" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	v, ok := s.values[r.PathValue("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"value": v})
+}
+
+func TestHTTPProvider(t *testing.T) {
+	stub := &vaultStub{values: map[string]string{"openai-key": "key-1"}}
+	mux := http.NewServeMux()
+	mux.Handle("GET /secrets/{name}", stub)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Setenv("TEST_VAULT_TOKEN", "vault-token")
+	Register("testvault", NewHTTPProvider(srv.URL, "env:TEST_VAULT_TOKEN"))
+	ctx := context.Background()
+
+	v := NewValue("testvault:openai-key")
+	if got := v.Get(); got != "key-1" {
+		t.Fatalf("resolved %q, want key-1", got)
+	}
+	if _, err := Resolve(ctx, "testvault:missing"); err == nil {
+		t.Fatal("resolving a missing secret succeeded")
+	}
+
+	stub.set("openai-key", "key-2")
+	refresh(ctx)
+	if got := v.Get(); got != "key-2" {
+		t.Fatalf("after rotation got %q, want key-2", got)
+	}
+
+	stub.setFailing(true)
+	stub.set("openai-key", "key-3")
+	refresh(ctx)
+	if got := v.Get(); got != "key-2" {
+		t.Fatalf("after a failed refresh got %q, want the previous key-2", got)
+	}
+
+	stub.setFailing(false)
+	refresh(ctx)
+	if got := v.Get(); got != "key-3" {
+		t.Fatalf("after recovery got %q, want key-3", got)
+	}
+}
@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPProvider reads secrets from a Key Vault-style REST API:
+// GET {baseURL}/secrets/{name}?api-version=7.4 returning {"value": "..."}.
+type HTTPProvider struct {
+	baseURL    string
+	tokenRef   string // bearer token, itself a reference so it can rotate
+	apiVersion string
+	client     *http.Client
+}
+
+func NewHTTPProvider(baseURL, tokenRef string) *HTTPProvider {
+	return &HTTPProvider{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		tokenRef:   tokenRef,
+		apiVersion: "7.4",
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPProvider) GetSecret(ctx context.Context, name string) (string, error) {
+	u := fmt.Sprintf("%s/secrets/%s?api-version=%s", p.baseURL, url.PathEscape(name), p.apiVersion)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	if p.tokenRef != "" {
+		token, err := Resolve(ctx, p.tokenRef)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return "", fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	return secret.Value, nil
+}
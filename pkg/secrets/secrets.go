@@ -0,0 +1,179 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// RefreshInterval is how often secret references are resolved again.
+	RefreshInterval = 5 * time.Minute
+)
+
+// SecretProvider resolves secrets by name from an external store.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+var (
+	mu        sync.Mutex
+	providers = map[string]SecretProvider{}
+	watchers  []*watcher
+)
+
+type watcher struct {
+	ref  string
+	last string
+	fn   func(string)
+}
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_SECRETS_REFRESH"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			RefreshInterval = d
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_KEYVAULT_URL"); v != "" {
+		Register("keyvault", NewHTTPProvider(v, os.Getenv("AZURE_OPENAI_PROXY_KEYVAULT_TOKEN")))
+		log.Printf("Key Vault secret provider enabled: %s", v)
+	}
+}
+
+// Register makes p available for references of the form "<scheme>:<name>".
+func Register(scheme string, p SecretProvider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[scheme] = p
+}
+
+// Resolve returns the value a reference points to. Supported forms are
+// "file:<path>", "env:<VAR>" and "<scheme>:<name>" for registered providers.
+// Anything else is returned as-is, so plain values keep working.
+func Resolve(ctx context.Context, ref string) (string, error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	if !ok {
+		return ref, nil
+	}
+	switch scheme {
+	case "file":
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case "env":
+		return os.Getenv(name), nil
+	}
+
+	mu.Lock()
+	p, ok := providers[scheme]
+	mu.Unlock()
+	if !ok {
+		return ref, nil
+	}
+	v, err := p.GetSecret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s secret %q: %w", scheme, name, err)
+	}
+	return v, nil
+}
+
+// Watch resolves ref, passes the value to fn and, when ref is a reference,
+// calls fn again whenever a periodic refresh sees the value change.
+func Watch(ref string, fn func(string)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	v, err := Resolve(ctx, ref)
+	if err != nil {
+		log.Printf("Error resolving secret: %v", err)
+	} else {
+		fn(v)
+	}
+
+	if !isReference(ref) {
+		return
+	}
+	mu.Lock()
+	watchers = append(watchers, &watcher{ref: ref, last: v, fn: fn})
+	mu.Unlock()
+}
+
+// StartRefresh periodically resolves every watched reference again.
+func StartRefresh(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				refresh(ctx)
+			}
+		}
+	}()
+}
+
+func refresh(ctx context.Context) {
+	mu.Lock()
+	list := append([]*watcher(nil), watchers...)
+	mu.Unlock()
+
+	for _, w := range list {
+		v, err := Resolve(ctx, w.ref)
+		if err != nil {
+			// Keep the last good value until the source recovers.
+			log.Printf("Error refreshing secret: %v", err)
+			continue
+		}
+		if v != w.last {
+			w.last = v
+			w.fn(v)
+		}
+	}
+}
+
+func isReference(ref string) bool {
+	scheme, _, ok := strings.Cut(ref, ":")
+	if !ok {
+		return false
+	}
+	if scheme == "file" || scheme == "env" {
+		return true
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok = providers[scheme]
+	return ok
+}
+
+// Value is a secret kept up to date by the periodic refresh.
+type Value struct {
+	mu sync.RWMutex
+	v  string
+}
+
+// NewValue resolves ref and keeps the result current.
+func NewValue(ref string) *Value {
+	v := &Value{}
+	Watch(ref, v.set)
+	return v
+}
+
+func (v *Value) Get() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.v
+}
+
+func (v *Value) set(s string) {
+	v.mu.Lock()
+	v.v = s
+	v.mu.Unlock()
+}
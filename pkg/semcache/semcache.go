@@ -0,0 +1,205 @@
+package semcache
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// Model is the embeddings model questions are embedded with, routed like
+	// any other request. The semantic cache is disabled when empty.
+	Model = ""
+	// Threshold is the cosine similarity from which a cached answer is used.
+	Threshold = 0.95
+	// TTL is how long answers stay in the cache.
+	TTL = time.Hour
+	// MaxEntries bounds the answers kept per partition (model, system
+	// prompt, parameters and caller scope). Searches are brute force, which
+	// is fast enough at this size.
+	MaxEntries = 1000
+)
+
+func init() {
+	Model = os.Getenv("AZURE_OPENAI_PROXY_SEMANTIC_CACHE_MODEL")
+	if v, err := strconv.ParseFloat(os.Getenv("AZURE_OPENAI_PROXY_SEMANTIC_CACHE_THRESHOLD"), 64); err == nil {
+		Threshold = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("AZURE_OPENAI_PROXY_SEMANTIC_CACHE_TTL")); err == nil && v > 0 {
+		TTL = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_PROXY_SEMANTIC_CACHE_MAX_ENTRIES")); err == nil && v > 0 {
+		MaxEntries = v
+	}
+	if Model != "" {
+		log.Printf("Semantic cache enabled with %s, threshold %.2f", Model, Threshold)
+	}
+}
+
+// SimilarityHeader carries the similarity of a cached answer's question.
+const SimilarityHeader = "x-proxy-cache-similarity"
+
+// Embed returns the embedding of a text. It is set by main, which owns the
+// reverse proxy the embeddings request goes through.
+var Embed func(ctx context.Context, model, text string) ([]float32, error)
+
+// Enabled reports whether the semantic cache is configured.
+func Enabled() bool {
+	return Model != "" && Embed != nil
+}
+
+// Query is a chat completion request prepared for the cache.
+type Query struct {
+	Partition string
+	Text      string // last user message
+	Vector    []float32
+}
+
+// NewQuery prepares a chat completion request body for the cache. Only
+// single questions are cached: the messages are system prompts followed by
+// one text-only user message. Everything else in the request, the caller's
+// scope and the deployment make up the partition it is looked up in.
+func NewQuery(scope, deployment string, body []byte) (*Query, bool) {
+	messages := gjson.GetBytes(body, "messages").Array()
+	if len(messages) == 0 {
+		return nil, false
+	}
+	last := messages[len(messages)-1]
+	if last.Get("role").String() != "user" {
+		return nil, false
+	}
+	var system []any
+	for _, m := range messages[:len(messages)-1] {
+		if role := m.Get("role").String(); role != "system" && role != "developer" {
+			return nil, false
+		}
+		system = append(system, m.Value())
+	}
+	text, ok := messageText(last.Get("content"))
+	if !ok || text == "" {
+		return nil, false
+	}
+
+	var params map[string]any
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, false
+	}
+	params["messages"] = system
+	delete(params, "user")
+	rest, err := json.Marshal(params)
+	if err != nil {
+		return nil, false
+	}
+	key, err := cache.Key(scope, deployment, "semantic", rest)
+	if err != nil {
+		return nil, false
+	}
+	return &Query{Partition: key, Text: text}, true
+}
+
+// messageText returns the text of a message, which may be a string or a
+// list of parts. Messages with images or audio aren't cached.
+func messageText(content gjson.Result) (string, bool) {
+	if content.Type == gjson.String {
+		return content.String(), true
+	}
+	var parts []string
+	for _, p := range content.Array() {
+		if p.Get("type").String() != "text" {
+			return "", false
+		}
+		parts = append(parts, p.Get("text").String())
+	}
+	return strings.Join(parts, "\n"), len(parts) > 0
+}
+
+// Entry is a cached answer.
+type Entry struct {
+	ContentType string
+	Body        []byte
+	vector      []float32
+	expiresAt   time.Time
+}
+
+var (
+	mu         sync.Mutex
+	partitions = map[string][]*Entry{}
+)
+
+// Lookup returns the most similar cached answer in the query's partition
+// and its similarity. The entry is nil below Threshold.
+func Lookup(q *Query) (*Entry, float64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	entries := partitions[q.Partition][:0]
+	var best *Entry
+	bestSim := 0.0
+	for _, e := range partitions[q.Partition] {
+		if now.After(e.expiresAt) {
+			continue
+		}
+		entries = append(entries, e)
+		if sim := dot(q.Vector, e.vector); best == nil || sim > bestSim {
+			best, bestSim = e, sim
+		}
+	}
+	if len(entries) == 0 {
+		delete(partitions, q.Partition)
+	} else {
+		partitions[q.Partition] = entries
+	}
+	if bestSim < Threshold {
+		return nil, bestSim
+	}
+	return best, bestSim
+}
+
+// Store caches the answer to a query. The oldest answer of a full partition
+// makes room.
+func Store(q *Query, contentType string, body []byte) {
+	mu.Lock()
+	defer mu.Unlock()
+	entries := append(partitions[q.Partition], &Entry{ContentType: contentType, Body: body, vector: q.Vector, expiresAt: time.Now().Add(TTL)})
+	if len(entries) > MaxEntries {
+		entries = entries[len(entries)-MaxEntries:]
+	}
+	partitions[q.Partition] = entries
+}
+
+// Normalize scales v to unit length, so similarity is a dot product.
+func Normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	n := float32(1 / math.Sqrt(sum))
+	for i := range v {
+		v[i] *= n
+	}
+	return v
+}
+
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return float64(sum)
+}
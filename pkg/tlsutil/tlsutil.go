@@ -0,0 +1,149 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	CertFile     = ""
+	KeyFile      = ""
+	ClientCAFile = ""
+	// ClientAuth is "require" (default when a client CA is set) or "optional".
+	ClientAuth = "require"
+)
+
+// reloadCheckInterval bounds how often the files are stat'ed for changes.
+const reloadCheckInterval = 10 * time.Second
+
+func init() {
+	CertFile = os.Getenv("AZURE_OPENAI_PROXY_TLS_CERT_FILE")
+	KeyFile = os.Getenv("AZURE_OPENAI_PROXY_TLS_KEY_FILE")
+	ClientCAFile = os.Getenv("AZURE_OPENAI_PROXY_TLS_CLIENT_CA_FILE")
+	if v := os.Getenv("AZURE_OPENAI_PROXY_TLS_CLIENT_AUTH"); v != "" {
+		ClientAuth = strings.ToLower(v)
+	}
+}
+
+// Enabled reports whether TLS is configured for the proxy listener.
+func Enabled() bool {
+	return CertFile != "" && KeyFile != ""
+}
+
+// ServerConfig builds a TLS config whose certificate and client CA bundle
+// are reloaded from disk when the files change, so rotated certificates are
+// served without a restart.
+func ServerConfig() (*tls.Config, error) {
+	r := &reloader{}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	// http.Server adds h2 to a copy of its config, not to this one, which
+	// is what GetConfigForClient clones.
+	base := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.maybeReload()
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*r.cert}
+		if r.clientCAs != nil {
+			cfg.ClientCAs = r.clientCAs
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			if ClientAuth == "optional" {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+		return cfg, nil
+	}
+
+	if ClientCAFile != "" {
+		log.Printf("TLS enabled with client certificate verification (%s)", ClientAuth)
+	} else {
+		log.Printf("TLS enabled")
+	}
+	return base, nil
+}
+
+type reloader struct {
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+	checked   time.Time
+}
+
+func (r *reloader) maybeReload() {
+	r.mu.RLock()
+	due := time.Since(r.checked) >= reloadCheckInterval
+	r.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	r.mu.Lock()
+	r.checked = time.Now()
+	changed := r.modTimes != fileModTimes()
+	r.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if err := r.load(); err != nil {
+		// A half-written rotation shouldn't take the listener down, keep
+		// serving the previous certificate.
+		log.Printf("Error reloading TLS certificates: %v", err)
+		return
+	}
+	log.Printf("Reloaded TLS certificates")
+}
+
+func (r *reloader) load() error {
+	modTimes := fileModTimes()
+	cert, err := tls.LoadX509KeyPair(CertFile, KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	var pool *x509.CertPool
+	if ClientCAFile != "" {
+		pem, err := os.ReadFile(ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client CA bundle %s contains no certificates", ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	r.checked = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+func fileModTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, f := range []string{CertFile, KeyFile, ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// Exporter selects where spans are sent: "otlp", "stdout" or
+	// "file:<path>". Tracing is disabled when empty.
+	Exporter = ""
+)
+
+// tracer is resolved through the global provider, so spans started before
+// Setup (or with tracing disabled) are no-ops.
+var tracer = otel.Tracer("github.com/gyarbij/azure-oai-proxy")
+
+func init() {
+	Exporter = os.Getenv("AZURE_OPENAI_PROXY_TRACING")
+	if Exporter == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		Exporter = "otlp"
+	}
+}
+
+// Setup installs the tracer provider and the W3C trace context propagator.
+// The OTLP exporter is configured through the standard OTEL_EXPORTER_OTLP_*
+// variables.
+func Setup(ctx context.Context) error {
+	if Exporter == "" {
+		return nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch {
+	case Exporter == "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case Exporter == "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case strings.HasPrefix(Exporter, "file:"):
+		var f *os.File
+		if f, err = os.OpenFile(strings.TrimPrefix(Exporter, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", Exporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "azure-oai-proxy")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return err
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.Printf("Tracing enabled with %s exporter", Exporter)
+	return nil
+}
+
+// Start starts a span as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// of an incoming traceparent header.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		ctx, span := tracer.Start(ctx, strings.TrimSpace(c.Request.Method+" "+route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Transport wraps base so every upstream attempt gets a client span and
+// carries the trace context to Azure.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(res.StatusCode))
+	}
+	return res, nil
+}
@@ -0,0 +1,155 @@
+package upstream
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// MaxIdleConnsPerHost is how many idle connections are kept open to
+	// each backend.
+	MaxIdleConnsPerHost = 100
+	// MaxConnsPerHost caps the connections to each backend, 0 is unlimited.
+	MaxConnsPerHost = 0
+	// IdleConnTimeout closes connections that were idle this long.
+	IdleConnTimeout = 90 * time.Second
+	// DialTimeout and KeepAlive configure new TCP connections.
+	DialTimeout = 10 * time.Second
+	KeepAlive   = 30 * time.Second
+	// TLSHandshakeTimeout bounds the TLS handshake of new connections.
+	TLSHandshakeTimeout = 10 * time.Second
+	// ResponseHeaderTimeout is how long to wait for response headers once
+	// the request is sent. Reasoning models can think for minutes before
+	// answering a non-streamed request, so this is generous.
+	ResponseHeaderTimeout = 10 * time.Minute
+	// HTTP2 enables HTTP/2 to backends that support it.
+	HTTP2 = true
+	// Pools overrides the connection limits of single backends.
+	Pools = map[string]Pool{}
+)
+
+// Pool holds the connection limits of a backend.
+type Pool struct {
+	MaxConns int
+	MaxIdle  int
+}
+
+func init() {
+	intEnv("AZURE_OPENAI_PROXY_UPSTREAM_MAX_IDLE_CONNS", &MaxIdleConnsPerHost)
+	intEnv("AZURE_OPENAI_PROXY_UPSTREAM_MAX_CONNS", &MaxConnsPerHost)
+	durationEnv("AZURE_OPENAI_PROXY_UPSTREAM_IDLE_TIMEOUT", &IdleConnTimeout)
+	durationEnv("AZURE_OPENAI_PROXY_UPSTREAM_DIAL_TIMEOUT", &DialTimeout)
+	durationEnv("AZURE_OPENAI_PROXY_UPSTREAM_KEEPALIVE", &KeepAlive)
+	durationEnv("AZURE_OPENAI_PROXY_UPSTREAM_TLS_TIMEOUT", &TLSHandshakeTimeout)
+	durationEnv("AZURE_OPENAI_PROXY_UPSTREAM_RESPONSE_HEADER_TIMEOUT", &ResponseHeaderTimeout)
+	if v, err := strconv.ParseBool(os.Getenv("AZURE_OPENAI_PROXY_UPSTREAM_HTTP2")); err == nil {
+		HTTP2 = v
+	}
+
+	// backend=max_conns[:max_idle], comma-separated
+	if v := os.Getenv("AZURE_OPENAI_PROXY_UPSTREAM_POOLS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, limits, ok := strings.Cut(pair, "=")
+			if !ok {
+				continue
+			}
+			conns, idle, _ := strings.Cut(limits, ":")
+			p := Pool{MaxConns: MaxConnsPerHost, MaxIdle: MaxIdleConnsPerHost}
+			if n, err := strconv.Atoi(conns); err == nil {
+				p.MaxConns = n
+			}
+			if n, err := strconv.Atoi(idle); err == nil {
+				p.MaxIdle = n
+			}
+			Pools[strings.ToLower(strings.TrimSpace(name))] = p
+		}
+		log.Printf("Loaded upstream connection pools: %+v", Pools)
+	}
+
+	Client = &http.Client{Transport: Transport("")}
+}
+
+func intEnv(name string, v *int) {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		*v = n
+	}
+}
+
+func durationEnv(name string, v *time.Duration) {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		*v = d
+	}
+}
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[string]*http.Transport{}
+)
+
+// Transport returns the shared transport of a backend, so connections are
+// pooled across requests. Backends without their own limits in Pools share
+// the default transport, which pools per host anyway.
+func Transport(backend string) *http.Transport {
+	backend = strings.ToLower(backend)
+	p, ok := Pools[backend]
+	if !ok {
+		backend, p = "", Pool{MaxConns: MaxConnsPerHost, MaxIdle: MaxIdleConnsPerHost}
+	}
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[backend]; ok {
+		return t
+	}
+	t := newTransport(p)
+	transports[backend] = t
+	return t
+}
+
+func newTransport(p Pool) *http.Transport {
+	dialer := &net.Dialer{Timeout: DialTimeout, KeepAlive: KeepAlive}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     HTTP2,
+		MaxIdleConnsPerHost:   p.MaxIdle,
+		MaxConnsPerHost:       p.MaxConns,
+		IdleConnTimeout:       IdleConnTimeout,
+		TLSHandshakeTimeout:   TLSHandshakeTimeout,
+		ResponseHeaderTimeout: ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if HTTP2 {
+		// Ping idle HTTP/2 connections so dead ones are noticed before a
+		// request is sent on them.
+		t.HTTP2 = &http.HTTP2Config{SendPingTimeout: 30 * time.Second, PingTimeout: 15 * time.Second}
+	}
+	return t
+}
+
+// Client is for the proxy's own upstream calls (model listing, health
+// probes, key validation), sharing the default transport's connections.
+var Client *http.Client
+
+// BufferPool is shared by the reverse proxies for copying response bodies.
+var BufferPool httputil.BufferPool = &bufferPool{}
+
+type bufferPool struct{ pool sync.Pool }
+
+func (b *bufferPool) Get() []byte {
+	if buf, ok := b.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, 32*1024)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	b.pool.Put(&buf)
+}
@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// BenchmarkProxy compares building a reverse proxy per request over
+// http.DefaultTransport, as the handlers used to, with one proxy over the
+// shared transport and buffer pool. Run in parallel, so the default
+// transport's two idle connections per host show up as new connections.
+func BenchmarkProxy(b *testing.B) {
+	body := bytes.Repeat([]byte(`{"index":0,"embedding":[0.0123,-0.0456,0.0789]},`), 1400)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	rewrite := func(r *httputil.ProxyRequest) { r.SetURL(target) }
+
+	run := func(b *testing.B, proxy func() http.Handler) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				req := httptest.NewRequest("POST", "/v1/embeddings", bytes.NewReader([]byte(`{"input":"hello"}`)))
+				w := &countingWriter{header: http.Header{}}
+				proxy().ServeHTTP(w, req)
+				if w.status != http.StatusOK || w.n != len(body) {
+					b.Fatalf("status %d, %d bytes", w.status, w.n)
+				}
+			}
+		})
+	}
+
+	b.Run("per_request", func(b *testing.B) {
+		run(b, func() http.Handler {
+			return &httputil.ReverseProxy{Rewrite: rewrite, Transport: http.DefaultTransport}
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		shared := &httputil.ReverseProxy{Rewrite: rewrite, Transport: Transport(""), BufferPool: BufferPool}
+		run(b, func() http.Handler { return shared })
+	})
+}
+
+// countingWriter drops the response, so only the proxy's allocations count.
+type countingWriter struct {
+	header http.Header
+	status int
+	n      int
+}
+
+func (w *countingWriter) Header() http.Header { return w.header }
+
+func (w *countingWriter) WriteHeader(status int) { w.status = status }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.n += len(p)
+	return len(p), nil
+}